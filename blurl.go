@@ -3,13 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type Playlist struct {
@@ -44,10 +49,73 @@ func decompressData(data io.Reader) ([]byte, error) {
 	return decompressedData.Bytes(), nil
 }
 
-func GetMediaURL(blurl *BLURL) string {
+func isManifest(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return bytes.HasPrefix(trimmed, []byte("<")) || bytes.HasPrefix(trimmed, []byte("#EXTM3U"))
+}
+
+func decompressManifest(data []byte) ([]byte, error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		decompressor, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer decompressor.Close()
+
+		return io.ReadAll(decompressor)
+	}
+
+	if len(data) >= 2 && data[0] == 0x78 {
+		return decompressData(bytes.NewReader(data))
+	}
+
+	return data, nil
+}
+
+// GetInlineManifest decodes the manifest embedded in Playlist.Data which can be raw xml/m3u8,
+// base64 and optionally zlib or gzip compressed. It returns nil when the playlist has no inline manifest.
+func GetInlineManifest(playlist *Playlist) ([]byte, error) {
+	data := strings.TrimSpace(playlist.Data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if isManifest([]byte(data)) {
+		return []byte(data), nil
+	}
+
+	decoded, err := decompressManifest([]byte(data))
+	if err == nil && isManifest(decoded) {
+		return decoded, nil
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		decoded, err = encoding.DecodeString(data)
+		if err != nil {
+			continue
+		}
+
+		decoded, err = decompressManifest(decoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress inline manifest: %v", err)
+		}
+
+		if isManifest(decoded) {
+			return decoded, nil
+		}
+	}
+
+	return nil, errors.New("playlist data is not a recognizable manifest")
+}
+
+func GetPlaylist(blurl *BLURL) *Playlist {
+	if len(blurl.Playlists) == 1 {
+		return &blurl.Playlists[0]
+	}
+
 	fmt.Println("Available playlists:")
 	for i, playlist := range blurl.Playlists {
-		fmt.Printf("%d: %s\n", i+1, playlist.Language)
+		fmt.Printf("%d: %s (%s)\n", i+1, playlist.Language, playlist.Type)
 	}
 	fmt.Print("Enter the number of your preferred playlist: ")
 
@@ -57,17 +125,61 @@ func GetMediaURL(blurl *BLURL) string {
 		choice, err := strconv.Atoi(input)
 		if err != nil {
 			fmt.Println("Invalid input, please enter a number")
-			return ""
+			return nil
 		}
 		if choice < 1 || choice > len(blurl.Playlists) {
 			fmt.Println("Selected number is out of range")
-			return ""
+			return nil
 		}
-		return blurl.Playlists[choice-1].URL
+		return &blurl.Playlists[choice-1]
 	} else {
 		fmt.Println("Failed to read input")
-		return ""
+		return nil
+	}
+}
+
+func LoadBLURL(input string) (BLURL, error) {
+	var blurl BLURL
+
+	if strings.HasSuffix(input, ".blurl") {
+		return blurl, parseBLURL(&blurl, input)
+	}
+
+	if strings.HasSuffix(input, ".json") {
+		return blurl, parseBLURLFromJSON(&blurl, input)
+	}
+
+	if isManifestInput(input) {
+		return manifestBLURL(input)
+	}
+
+	return blurl, errors.New("input must be a blurl, a json or a manifest")
+}
+
+func isManifestInput(input string) bool {
+	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(input))
+	return ext == ".mpd" || ext == ".m3u8"
+}
+
+// manifestBLURL wraps a manifest url or file in a blurl without an envelope, its keys come from
+// -key, -key-file or the key cache.
+func manifestBLURL(input string) (BLURL, error) {
+	manifesturl := input
+
+	if !strings.HasPrefix(input, "http://") && !strings.HasPrefix(input, "https://") {
+		abs, err := filepath.Abs(input)
+		if err != nil {
+			return BLURL{}, err
+		}
+
+		manifesturl = (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
 	}
+
+	return BLURL{Type: "vod", Playlists: []Playlist{{URL: manifesturl}}}, nil
 }
 
 func parseBLURLFromJSON(inblurl *BLURL, filepath string) error {
@@ -79,25 +191,28 @@ func parseBLURLFromJSON(inblurl *BLURL, filepath string) error {
 
 	err = json.NewDecoder(file).Decode(&inblurl)
 	if err != nil {
-		log.Fatalf("Error decoding JSON: %v", err)
+		return fmt.Errorf("Error decoding JSON: %v", err)
 	}
 
 	return nil
 }
 
 func parseBLURL(inblurl *BLURL, filepath string) error {
-	file, err := os.Open(filepath)
+	data, err := os.ReadFile(filepath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = file.Seek(8, 0)
-	if err != nil {
-		return err
+	return decodeBLURL(data, inblurl)
+}
+
+// decodeBLURL parses the contents of a .blurl file, an 8 byte header followed by zlib compressed json.
+func decodeBLURL(data []byte, inblurl *BLURL) error {
+	if len(data) < 8 {
+		return fmt.Errorf("blurl is too short (%d bytes)", len(data))
 	}
 
-	decompressedData, err := decompressData(file)
+	decompressedData, err := decompressData(bytes.NewReader(data[8:]))
 	if err != nil {
 		return err
 	}
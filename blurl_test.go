@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// encodeTestBLURL writes blurl the way .blurl files are laid out, the 8 byte header is not read.
+func encodeTestBLURL(t testing.TB, blurl BLURL) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(blurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encoded bytes.Buffer
+	encoded.Write([]byte("blul\x00\x00\x00\x00"))
+
+	compressor := zlib.NewWriter(&encoded)
+	compressor.Write(data)
+	compressor.Close()
+
+	return encoded.Bytes()
+}
+
+func testBLURL() BLURL {
+	return BLURL{
+		AudioOnly: true,
+		Ev:        "AQAHAABhLW5vbmNlAAAAAAAAAAAAAAAAAAAAAA==",
+		Type:      "vod",
+		Playlists: []Playlist{{
+			Data:     "",
+			Duration: 30.5,
+			Language: "en",
+			Type:     "main",
+			URL:      "https://example.com/a/master.blurl",
+		}},
+	}
+}
+
+func TestLoadBLURLMalformedJSON(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "broken.json")
+	err := os.WriteFile(input, []byte(`{"playlists": [`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the error has to reach the result document instead of ending the process
+	if _, err := LoadBLURL(input); err == nil {
+		t.Fatal("expected an error for malformed json")
+	}
+}
+
+func FuzzDecodeBLURL(f *testing.F) {
+	f.Add(encodeTestBLURL(f, testBLURL()))
+	f.Add(encodeTestBLURL(f, BLURL{}))
+	f.Add([]byte("blul\x00\x00\x00\x00x\x9c"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var blurl BLURL
+		decodeBLURL(data, &blurl)
+	})
+}
+
+func FuzzBLURLRoundTrip(f *testing.F) {
+	f.Add(true, "AQAHAABhLW5vbmNl", "vod", "en", "main", "https://example.com/a/master.blurl", "", 30.5)
+	f.Add(false, "", "", "", "", "", "PE1QRC8+", 0.0)
+
+	f.Fuzz(func(t *testing.T, audioonly bool, ev string, blurltype string, language string, playlisttype string, url string, data string, duration float64) {
+		want := BLURL{
+			AudioOnly: audioonly,
+			Ev:        ev,
+			Type:      blurltype,
+			Playlists: []Playlist{{Data: data, Duration: duration, Language: language, Type: playlisttype, URL: url}},
+		}
+
+		encoded, err := json.Marshal(want)
+		if err != nil {
+			// NaN and infinite durations have no json form
+			t.Skip()
+		}
+
+		// going through json once normalizes invalid utf-8 the same way decoding will
+		var normalized BLURL
+		if err := json.Unmarshal(encoded, &normalized); err != nil {
+			t.Fatal(err)
+		}
+
+		var got BLURL
+		if err := decodeBLURL(encodeTestBLURL(t, normalized), &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, normalized) {
+			t.Fatalf("got %+v, want %+v", got, normalized)
+		}
+	})
+}
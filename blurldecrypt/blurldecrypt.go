@@ -2,17 +2,18 @@ package blurldecrypt
 
 import (
 	"crypto/aes"
-	"crypto/md5"
 	"errors"
 	"fmt"
-	"io"
-	"os"
 )
 
+// Envelope is a parsed EV. FirstByte is the version and selects the unwrap algorithm, Wrapped is the
+// wrapped key as it appears in the envelope and Key a copy of it for the 16 byte formats.
 type Envelope struct {
 	FirstByte byte
 	Nonce     string
 	Key       [16]byte
+	IV        []byte
+	Wrapped   []byte
 }
 
 func AesDecrypt(key []byte, bytes []byte) ([]byte, error) {
@@ -41,74 +42,89 @@ func ParseEV(b []byte) (Envelope, error) {
 
 	data.FirstByte = b[0]
 
-	if data.FirstByte != 1 {
+	algorithm, ok := GetUnwrapAlgorithm(data.FirstByte)
+	if !ok {
 		return data, fmt.Errorf("Invalid EV")
 	}
 
-	stringLength := b[2]
-	if len(b) < 5+int(stringLength)+16 {
+	length, err := EnvelopeLength(b)
+	if err != nil {
+		return data, err
+	}
+
+	if len(b) < length {
 		return data, fmt.Errorf("invalid key length")
 	}
 
+	stringLength := int(b[2])
 	data.Nonce = string(b[5 : 5+stringLength])
 
+	offset := 5 + stringLength
+	data.IV = append([]byte(nil), b[offset:offset+algorithm.IVSize]...)
+
+	offset += algorithm.IVSize
+	data.Wrapped = append([]byte(nil), b[offset:offset+algorithm.WrappedSize]...)
+
 	// copy the key to the struct
-	copy(data.Key[:], b[5+stringLength:5+stringLength+16])
+	copy(data.Key[:], data.Wrapped)
 
 	return data, nil
 }
 
-func GetEncryptionKey(filePath, nonce string, encryptedkey []byte) []byte {
-	file, err := os.Open(filePath)
+func GetEncryptionKey(filePath, nonce string, encryptedkey []byte) ([]byte, error) {
+	store, err := OpenKeyStore(filePath)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return nil
+		return nil, err
 	}
-	defer file.Close()
 
-	offset := int64(0)
-	for {
-
-		file.Seek(offset, 0)
-
-		var first5Bytes [5]byte
+	return store.UnwrapKey(nonce, encryptedkey)
+}
 
-		_, err = file.Read(first5Bytes[:])
+// GetEnvelopeKey unwraps the key of envelope with the record for its nonce in the key store at filePath.
+func GetEnvelopeKey(filePath string, envelope Envelope) ([]byte, error) {
+	store, err := OpenKeyStore(filePath)
+	if err != nil {
+		return nil, err
+	}
 
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Println("Error reading file:", err)
-			break
-		}
+	return store.Unwrap(envelope)
+}
 
-		hash := md5.New()
-		hash.Write(first5Bytes[:4])
-		hash.Write([]byte(nonce))
-		result := hash.Sum(nil)
+// FindEncryptionKey searches the key stores in order and returns the first key that unwraps. A
+// store that is missing or holds no key for the nonce is skipped, any other error stops the search.
+func FindEncryptionKey(filePaths []string, nonce string, encryptedkey []byte) ([]byte, error) {
+	envelope := Envelope{FirstByte: 1, Nonce: nonce, Wrapped: encryptedkey}
+	copy(envelope.Key[:], encryptedkey)
 
-		if result[0] == first5Bytes[4] {
-			// Getting the encryption key for the encryption key after we find the right key
-			file.Seek(15, io.SeekCurrent)
+	return FindEnvelopeKey(filePaths, envelope)
+}
 
-			var EncryptionKey [32]byte
-			_, err = file.Read(EncryptionKey[:])
-			if err != nil && err != io.EOF {
-				fmt.Println("Error Getting Encryption Key:", err)
-				break
-			}
+// FindEnvelopeKey is FindEncryptionKey for envelopes of any version.
+func FindEnvelopeKey(filePaths []string, envelope Envelope) ([]byte, error) {
+	if len(filePaths) == 0 {
+		return nil, ErrKeyStoreNotFound
+	}
 
-			encryptionkey, err := AesDecrypt(EncryptionKey[:], encryptedkey)
+	searched := 0
+	for _, filePath := range filePaths {
+		key, err := GetEnvelopeKey(filePath, envelope)
+		if err == nil {
+			return key, nil
+		}
 
-			if err != nil {
-				fmt.Println("failed to decrypt encryption key:", err)
-			}
+		if errors.Is(err, ErrKeyStoreNotFound) {
+			continue
+		}
+		searched++
 
-			return encryptionkey
+		if !errors.Is(err, ErrNoMatchingKey) {
+			return nil, err
 		}
+	}
 
-		offset += 0x34
+	if searched == 0 {
+		return nil, ErrKeyStoreNotFound
 	}
-	return nil
+
+	return nil, fmt.Errorf("%w for nonce %q", ErrNoMatchingKey, envelope.Nonce)
 }
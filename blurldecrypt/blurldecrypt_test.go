@@ -0,0 +1,278 @@
+package blurldecrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func buildTestEV(nonce string, key [16]byte) []byte {
+	ev, err := MarshalEV(Envelope{Nonce: nonce, Key: key})
+	if err != nil {
+		panic(err)
+	}
+	return ev
+}
+
+func TestParseEV(t *testing.T) {
+	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	envelope, err := ParseEV(buildTestEV("a-nonce", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.Nonce != "a-nonce" || envelope.Key != key || envelope.FirstByte != 1 {
+		t.Fatalf("got %+v", envelope)
+	}
+
+	for _, invalid := range [][]byte{nil, {1}, {1, 0}, {1, 0, 4, 0}, {2, 0, 0, 0, 0}, buildTestEV("nonce", key)[:20]} {
+		if _, err := ParseEV(invalid); err == nil {
+			t.Errorf("%x: expected an error", invalid)
+		}
+	}
+}
+
+func TestBuildEV(t *testing.T) {
+	contentkey := [16]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	storekey := [32]byte{31: 1}
+
+	ev, record, err := BuildEV(contentkey, "a-nonce", [4]byte{1, 2, 3, 4}, storekey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record that doesn't match comes first so the check byte has to do its job, its check byte is
+	// 0xe6 where "a-nonce" would need 0x52
+	other := NewKeyRecord([4]byte{9, 9, 9, 9}, "another-nonce", [32]byte{})
+	if other.Matches("a-nonce") {
+		t.Fatal("the other record matches a-nonce, pick another id or nonce")
+	}
+
+	store, err := ParseKeyStore(append(other.Bytes(), record.Bytes()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := ParseEV(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := store.UnwrapKey(envelope.Nonce, envelope.Key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(key, contentkey[:]) {
+		t.Fatalf("got %x, want %x", key, contentkey)
+	}
+
+	if _, _, err := BuildEV(contentkey, string(make([]byte, 256)), [4]byte{}, storekey); err == nil {
+		t.Fatal("expected an error for a 256 byte nonce")
+	}
+}
+
+func TestAESKW(t *testing.T) {
+	// RFC 3394 section 4.6, 128 bits of key data wrapped with a 256 bit key
+	storekey, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+	want, _ := hex.DecodeString("64E8C3F9CE0F5BA263E9777905818A2A93C8191E7D6E8AE7")
+
+	wrapped, err := WrapAESKW(storekey, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(wrapped, want) {
+		t.Fatalf("got %x, want %x", wrapped, want)
+	}
+
+	unwrapped, err := UnwrapAESKW(storekey, nil, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatalf("got %x, want %x", unwrapped, key)
+	}
+
+	wrapped[0] ^= 1
+	if _, err := UnwrapAESKW(storekey, nil, wrapped); err == nil {
+		t.Fatal("expected the integrity check to fail")
+	}
+}
+
+// registerTestAlgorithm registers algorithm for version until the test ends.
+func registerTestAlgorithm(t *testing.T, version byte, algorithm UnwrapAlgorithm) {
+	t.Helper()
+
+	if _, ok := GetUnwrapAlgorithm(version); ok {
+		t.Fatalf("version %d is already registered", version)
+	}
+
+	RegisterUnwrapAlgorithm(version, algorithm)
+
+	t.Cleanup(func() {
+		algorithmsMu.Lock()
+		defer algorithmsMu.Unlock()
+		delete(algorithms, version)
+	})
+}
+
+func TestEnvelopeVersions(t *testing.T) {
+	contentkey := [16]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	storekey := [32]byte{31: 1}
+
+	// only version 1 is known, the others show the registry carries the layout through parsing
+	registerTestAlgorithm(t, 0xf2, AESCBC)
+	registerTestAlgorithm(t, 0xf3, AESKW)
+
+	for _, version := range []byte{1, 0xf2, 0xf3} {
+		algorithm, _ := GetUnwrapAlgorithm(version)
+
+		t.Run(algorithm.Name, func(t *testing.T) {
+			ev, record, err := BuildVersionedEV(version, contentkey, "a-nonce", [4]byte{1, 2, 3, 4}, storekey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			length, err := EnvelopeLength(ev)
+			if err != nil || length != len(ev) {
+				t.Fatalf("got length %d, %v for a %d byte envelope", length, err, len(ev))
+			}
+
+			envelope, err := ParseEV(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if envelope.FirstByte != version || len(envelope.IV) != algorithm.IVSize || len(envelope.Wrapped) != algorithm.WrappedSize {
+				t.Fatalf("got %+v", envelope)
+			}
+
+			store, err := ParseKeyStore(record.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := store.Unwrap(envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(key, contentkey[:]) {
+				t.Fatalf("got %x, want %x", key, contentkey)
+			}
+
+			if _, err := ParseEV(ev[:len(ev)-1]); err == nil {
+				t.Fatal("expected an error for a truncated envelope")
+			}
+		})
+	}
+
+	ev, record, err := BuildVersionedEV(0xf3, contentkey, "a-nonce", [4]byte{1, 2, 3, 4}, [32]byte{31: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := ParseEV(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record.Key = storekey
+	store, err := ParseKeyStore(record.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Unwrap(envelope); !errors.Is(err, ErrUnwrapFailed) {
+		t.Fatalf("got %v, want ErrUnwrapFailed for the wrong store key", err)
+	}
+
+	for _, version := range []byte{2, 3, 9} {
+		if _, _, err := BuildVersionedEV(version, contentkey, "a-nonce", [4]byte{}, storekey); err == nil {
+			t.Fatalf("expected an error for the unregistered version %d", version)
+		}
+	}
+}
+
+func FuzzParseEV(f *testing.F) {
+	f.Add(buildTestEV("a-nonce", [16]byte{}))
+	f.Add(buildTestEV("", [16]byte{0xff}))
+	f.Add([]byte{1, 0, 255, 0, 0})
+	f.Add([]byte{1})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		envelope, err := ParseEV(b)
+		if err != nil {
+			return
+		}
+
+		offset := 5 + len(envelope.Nonce)
+		if len(b) < offset+len(envelope.IV)+len(envelope.Wrapped) {
+			t.Fatalf("parsed a %d byte nonce out of %d bytes", len(envelope.Nonce), len(b))
+		}
+
+		if !bytes.Equal(envelope.IV, b[offset:offset+len(envelope.IV)]) {
+			t.Fatal("iv does not follow the nonce")
+		}
+
+		offset += len(envelope.IV)
+		if !bytes.Equal(envelope.Wrapped, b[offset:offset+len(envelope.Wrapped)]) {
+			t.Fatal("wrapped key does not follow the iv")
+		}
+	})
+}
+
+func FuzzParseEVRoundTrip(f *testing.F) {
+	f.Add("a-nonce", []byte("0123456789abcdef"))
+	f.Add("", []byte{})
+
+	f.Fuzz(func(t *testing.T, nonce string, keybytes []byte) {
+		if len(nonce) > 255 {
+			nonce = nonce[:255]
+		}
+
+		var key [16]byte
+		copy(key[:], keybytes)
+
+		envelope, err := ParseEV(buildTestEV(nonce, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if envelope.Nonce != nonce || envelope.Key != key {
+			t.Fatalf("got %q %x, want %q %x", envelope.Nonce, envelope.Key, nonce, key)
+		}
+	})
+}
+
+func FuzzParseKeyStore(f *testing.F) {
+	f.Add(bytes.Repeat([]byte{0xab}, KeyRecordSize))
+	f.Add(bytes.Repeat([]byte{0x01}, KeyRecordSize*2+20))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		store, err := ParseKeyStore(data)
+		if err != nil {
+			if len(data) >= KeyRecordSize {
+				t.Fatalf("%d bytes hold a complete record but failed: %v", len(data), err)
+			}
+			return
+		}
+
+		if store.Len() != len(data)/KeyRecordSize {
+			t.Fatalf("got %d records from %d bytes", store.Len(), len(data))
+		}
+
+		if !bytes.Equal(store.Bytes(), data) {
+			t.Fatal("serializing the store does not give back its input")
+		}
+
+		store.Lookup("nonce")
+	})
+}
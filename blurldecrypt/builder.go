@@ -0,0 +1,96 @@
+package blurldecrypt
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+func AesEncrypt(key []byte, bytes []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes)%block.BlockSize() != 0 {
+		return nil, errors.New("plaintext is not a multiple of the block size")
+	}
+
+	encrypted := make([]byte, len(bytes))
+	for i := 0; i < len(bytes); i += block.BlockSize() {
+		block.Encrypt(encrypted[i:i+block.BlockSize()], bytes[i:i+block.BlockSize()])
+	}
+
+	return encrypted, nil
+}
+
+// MarshalEV is the inverse of ParseEV: the version byte, an unused byte, the nonce length, two
+// unused bytes, the nonce, the iv if the version has one and the wrapped key. Key is used when
+// Wrapped is empty.
+func MarshalEV(envelope Envelope) ([]byte, error) {
+	if len(envelope.Nonce) > 255 {
+		return nil, fmt.Errorf("nonce is %d bytes, at most 255 fit", len(envelope.Nonce))
+	}
+
+	version := envelope.FirstByte
+	if version == 0 {
+		version = 1
+	}
+
+	algorithm, ok := GetUnwrapAlgorithm(version)
+	if !ok {
+		return nil, fmt.Errorf("unsupported EV version %d", version)
+	}
+
+	wrapped := envelope.Wrapped
+	if len(wrapped) == 0 {
+		wrapped = envelope.Key[:]
+	}
+
+	if len(envelope.IV) != algorithm.IVSize || len(wrapped) != algorithm.WrappedSize {
+		return nil, fmt.Errorf("version %d envelopes need a %d byte iv and a %d byte wrapped key", version, algorithm.IVSize, algorithm.WrappedSize)
+	}
+
+	b := []byte{version, 0, byte(len(envelope.Nonce)), 0, 0}
+	b = append(b, envelope.Nonce...)
+	b = append(b, envelope.IV...)
+	return append(b, wrapped...), nil
+}
+
+// NewKeyRecord returns the keys.bin record with the given id and key that GetEncryptionKey picks for nonce.
+func NewKeyRecord(id [4]byte, nonce string, key [32]byte) KeyRecord {
+	return KeyRecord{ID: id, Check: CheckByte(id, nonce), Key: key}
+}
+
+// BuildEV wraps contentkey with storekey and returns a version 1 envelope for nonce together with
+// the keys.bin record that unwraps it, so key derivation can be exercised without real assets.
+func BuildEV(contentkey [16]byte, nonce string, id [4]byte, storekey [32]byte) ([]byte, KeyRecord, error) {
+	return BuildVersionedEV(1, contentkey, nonce, id, storekey)
+}
+
+// BuildVersionedEV is BuildEV for any registered envelope version, a random iv is used when the
+// version needs one.
+func BuildVersionedEV(version byte, contentkey [16]byte, nonce string, id [4]byte, storekey [32]byte) ([]byte, KeyRecord, error) {
+	algorithm, ok := GetUnwrapAlgorithm(version)
+	if !ok {
+		return nil, KeyRecord{}, fmt.Errorf("unsupported EV version %d", version)
+	}
+
+	iv := make([]byte, algorithm.IVSize)
+	_, err := rand.Read(iv)
+	if err != nil {
+		return nil, KeyRecord{}, err
+	}
+
+	wrapped, err := algorithm.Wrap(storekey[:], iv, contentkey[:])
+	if err != nil {
+		return nil, KeyRecord{}, err
+	}
+
+	ev, err := MarshalEV(Envelope{FirstByte: version, Nonce: nonce, IV: iv, Wrapped: wrapped})
+	if err != nil {
+		return nil, KeyRecord{}, err
+	}
+
+	return ev, NewKeyRecord(id, nonce, storekey), nil
+}
@@ -0,0 +1,277 @@
+package blurldecrypt
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const KeyRecordSize = 0x34
+
+var (
+	ErrKeyStoreNotFound = errors.New("key store not found")
+	ErrKeyStoreCorrupt  = errors.New("key store is corrupt")
+	ErrNoMatchingKey    = errors.New("no matching key")
+	ErrUnwrapFailed     = errors.New("failed to unwrap the encryption key")
+)
+
+// KeyRecord is one 52 byte entry of keys.bin.
+type KeyRecord struct {
+	ID       [4]byte
+	Check    byte
+	Reserved [15]byte
+	Key      [32]byte
+}
+
+// CheckByte is the byte a record for id must carry to be picked for nonce, the first byte of
+// md5(id + nonce).
+func CheckByte(id [4]byte, nonce string) byte {
+	hash := md5.New()
+	hash.Write(id[:])
+	hash.Write([]byte(nonce))
+	return hash.Sum(nil)[0]
+}
+
+// Matches reports whether the record holds the key for nonce.
+func (record *KeyRecord) Matches(nonce string) bool {
+	return CheckByte(record.ID, nonce) == record.Check
+}
+
+func (record *KeyRecord) Bytes() []byte {
+	b := make([]byte, 0, KeyRecordSize)
+	b = append(b, record.ID[:]...)
+	b = append(b, record.Check)
+	b = append(b, record.Reserved[:]...)
+	b = append(b, record.Key[:]...)
+	return b
+}
+
+// KeyStore is keys.bin parsed once into memory. Lookups are safe for concurrent use and the record
+// for a nonce is remembered after the first lookup.
+type KeyStore struct {
+	Path string
+
+	mu       sync.RWMutex
+	records  []KeyRecord
+	trailing []byte
+	byID     map[[4]byte]int
+	byNonce  map[string]int
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		byID:    make(map[[4]byte]int),
+		byNonce: make(map[string]int),
+	}
+}
+
+func ParseKeyRecord(b []byte) (KeyRecord, error) {
+	var record KeyRecord
+
+	if len(b) < KeyRecordSize {
+		return record, fmt.Errorf("%w: key record is %d bytes, expected %d", ErrKeyStoreCorrupt, len(b), KeyRecordSize)
+	}
+
+	copy(record.ID[:], b[0:4])
+	record.Check = b[4]
+	copy(record.Reserved[:], b[5:20])
+	copy(record.Key[:], b[20:52])
+
+	return record, nil
+}
+
+// ParseKeyStore indexes every complete record in data. A trailing partial record is never matched
+// but kept so that rewriting the store doesn't lose it.
+func ParseKeyStore(data []byte) (*KeyStore, error) {
+	store := NewKeyStore()
+
+	offset := 0
+	for ; offset+KeyRecordSize <= len(data); offset += KeyRecordSize {
+		record, err := ParseKeyRecord(data[offset : offset+KeyRecordSize])
+		if err != nil {
+			return nil, err
+		}
+
+		store.records = append(store.records, record)
+	}
+
+	store.trailing = append([]byte(nil), data[offset:]...)
+
+	if len(store.records) == 0 {
+		return nil, fmt.Errorf("%w: no complete records", ErrKeyStoreCorrupt)
+	}
+
+	store.reindex()
+
+	return store, nil
+}
+
+func LoadKeyStore(filePath string) (*KeyStore, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyStoreNotFound, filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := ParseKeyStore(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	store.Path = filePath
+	return store, nil
+}
+
+// reindex rebuilds the id index and forgets cached nonces, callers hold mu for writing.
+func (store *KeyStore) reindex() {
+	store.byID = make(map[[4]byte]int)
+	store.byNonce = make(map[string]int)
+
+	for idx, record := range store.records {
+		// the first record for an id wins, like the file scan it replaces
+		if _, ok := store.byID[record.ID]; !ok {
+			store.byID[record.ID] = idx
+		}
+	}
+}
+
+func (store *KeyStore) Records() []KeyRecord {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return append([]KeyRecord(nil), store.records...)
+}
+
+func (store *KeyStore) Len() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.records)
+}
+
+// Trailing returns the bytes after the last complete record.
+func (store *KeyStore) Trailing() []byte {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return append([]byte(nil), store.trailing...)
+}
+
+func (store *KeyStore) ByID(id [4]byte) (KeyRecord, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	idx, ok := store.byID[id]
+	if !ok {
+		return KeyRecord{}, false
+	}
+	return store.records[idx], true
+}
+
+// Add appends record. Ids may repeat, records are told apart by their check byte.
+func (store *KeyStore) Add(record KeyRecord) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.records = append(store.records, record)
+	store.reindex()
+}
+
+// Remove deletes the record at idx.
+func (store *KeyStore) Remove(idx int) (KeyRecord, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if idx < 0 || idx >= len(store.records) {
+		return KeyRecord{}, fmt.Errorf("no record at index %d", idx)
+	}
+
+	record := store.records[idx]
+	store.records = append(store.records[:idx:idx], store.records[idx+1:]...)
+	store.reindex()
+
+	return record, nil
+}
+
+// Bytes serializes the store back to the keys.bin layout.
+func (store *KeyStore) Bytes() []byte {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	data := make([]byte, 0, len(store.records)*KeyRecordSize+len(store.trailing))
+	for _, record := range store.records {
+		data = append(data, record.Bytes()...)
+	}
+
+	return append(data, store.trailing...)
+}
+
+// Lookup returns the first record matching nonce.
+func (store *KeyStore) Lookup(nonce string) (KeyRecord, bool) {
+	store.mu.RLock()
+	idx, ok := store.byNonce[nonce]
+	if !ok {
+		idx = -1
+		for i := range store.records {
+			if store.records[i].Matches(nonce) {
+				idx = i
+				break
+			}
+		}
+	}
+	var record KeyRecord
+	if idx >= 0 {
+		record = store.records[idx]
+	}
+	store.mu.RUnlock()
+
+	if !ok {
+		store.mu.Lock()
+		store.byNonce[nonce] = idx
+		store.mu.Unlock()
+	}
+
+	return record, idx >= 0
+}
+
+// UnwrapKey decrypts the key of a version 1 envelope with the record matching nonce.
+func (store *KeyStore) UnwrapKey(nonce string, encryptedkey []byte) ([]byte, error) {
+	return store.Unwrap(Envelope{FirstByte: 1, Nonce: nonce, Wrapped: encryptedkey})
+}
+
+// Unwrap unwraps the key of envelope with the record matching its nonce.
+func (store *KeyStore) Unwrap(envelope Envelope) ([]byte, error) {
+	record, ok := store.Lookup(envelope.Nonce)
+	if !ok {
+		return nil, fmt.Errorf("%w for nonce %q in %s", ErrNoMatchingKey, envelope.Nonce, store.Path)
+	}
+
+	return UnwrapEnvelopeKey(record.Key[:], envelope)
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*KeyStore)
+)
+
+// OpenKeyStore loads filePath the first time it is asked for and returns the same store afterwards.
+func OpenKeyStore(filePath string) (*KeyStore, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if store, ok := stores[filePath]; ok {
+		return store, nil
+	}
+
+	store, err := LoadKeyStore(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	stores[filePath] = store
+	return store, nil
+}
@@ -0,0 +1,193 @@
+package blurldecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// UnwrapAlgorithm describes what follows the nonce in an envelope of one version and how the
+// wrapped key is unwrapped with the 32 byte key from keys.bin.
+type UnwrapAlgorithm struct {
+	Name        string
+	IVSize      int
+	WrappedSize int
+	Unwrap      func(storekey []byte, iv []byte, wrapped []byte) ([]byte, error)
+	Wrap        func(storekey []byte, iv []byte, key []byte) ([]byte, error)
+}
+
+var (
+	// AESECB is the algorithm of version 1 envelopes, the only version seen so far.
+	AESECB = UnwrapAlgorithm{Name: "aes-ecb", WrappedSize: 16, Unwrap: unwrapECB, Wrap: wrapECB}
+
+	// AESCBC wraps a 16 byte key with aes-cbc under an iv that follows the nonce. Nothing checks the
+	// integrity of the unwrapped key, so only register it for a version known to use exactly this layout.
+	AESCBC = UnwrapAlgorithm{Name: "aes-cbc", IVSize: aes.BlockSize, WrappedSize: 16, Unwrap: unwrapCBC, Wrap: wrapCBC}
+
+	// AESKW wraps a 16 byte key with the RFC 3394 key wrap into 24 bytes that follow the nonce.
+	AESKW = UnwrapAlgorithm{Name: "aes-kw", WrappedSize: 24, Unwrap: UnwrapAESKW, Wrap: WrapAESKW}
+)
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = map[byte]UnwrapAlgorithm{
+		1: AESECB,
+	}
+)
+
+// RegisterUnwrapAlgorithm makes envelopes starting with version use algorithm, e.g. AESCBC or AESKW
+// once a version using them turns up.
+func RegisterUnwrapAlgorithm(version byte, algorithm UnwrapAlgorithm) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+
+	algorithms[version] = algorithm
+}
+
+func GetUnwrapAlgorithm(version byte) (UnwrapAlgorithm, bool) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	algorithm, ok := algorithms[version]
+	return algorithm, ok
+}
+
+// EnvelopeLength returns how long an envelope with the header at the start of b is.
+func EnvelopeLength(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 0, fmt.Errorf("invalid EV length")
+	}
+
+	algorithm, ok := GetUnwrapAlgorithm(b[0])
+	if !ok {
+		return 0, fmt.Errorf("unsupported EV version %d", b[0])
+	}
+
+	return 5 + int(b[2]) + algorithm.IVSize + algorithm.WrappedSize, nil
+}
+
+// UnwrapEnvelopeKey unwraps the key of envelope with the algorithm its version selects.
+func UnwrapEnvelopeKey(storekey []byte, envelope Envelope) ([]byte, error) {
+	algorithm, ok := GetUnwrapAlgorithm(envelope.FirstByte)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported EV version %d", ErrUnwrapFailed, envelope.FirstByte)
+	}
+
+	key, err := algorithm.Unwrap(storekey, envelope.IV, envelope.Wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnwrapFailed, algorithm.Name, err)
+	}
+
+	return key, nil
+}
+
+func unwrapECB(storekey []byte, iv []byte, wrapped []byte) ([]byte, error) {
+	return AesDecrypt(storekey, wrapped)
+}
+
+func wrapECB(storekey []byte, iv []byte, key []byte) ([]byte, error) {
+	return AesEncrypt(storekey, key)
+}
+
+func unwrapCBC(storekey []byte, iv []byte, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(storekey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(wrapped) == 0 || len(wrapped)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid iv or ciphertext length")
+	}
+
+	key := make([]byte, len(wrapped))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(key, wrapped)
+	return key, nil
+}
+
+func wrapCBC(storekey []byte, iv []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(storekey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(key) == 0 || len(key)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid iv or plaintext length")
+	}
+
+	wrapped := make([]byte, len(key))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(wrapped, key)
+	return wrapped, nil
+}
+
+var aeskwIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// WrapAESKW wraps key with the RFC 3394 key wrap algorithm, the iv is not used.
+func WrapAESKW(storekey []byte, iv []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(storekey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errors.New("key to wrap must be a multiple of 8 bytes and at least 16")
+	}
+
+	n := len(key) / 8
+	r := make([]byte, len(key))
+	copy(r, key)
+
+	a := make([]byte, 8)
+	copy(a, aeskwIV)
+
+	b := make([]byte, aes.BlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(b[:8], a)
+			copy(b[8:], r[i*8:i*8+8])
+			block.Encrypt(b, b)
+
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(r[i*8:i*8+8], b[8:])
+		}
+	}
+
+	return append(a, r...), nil
+}
+
+// UnwrapAESKW reverses WrapAESKW and fails when the integrity check value doesn't match.
+func UnwrapAESKW(storekey []byte, iv []byte, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(storekey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("wrapped key must be a multiple of 8 bytes and at least 24")
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	b := make([]byte, aes.BlockSize)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r[i*8:i*8+8])
+			block.Decrypt(b, b)
+
+			copy(a, b[:8])
+			copy(r[i*8:i*8+8], b[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, aeskwIV) != 1 {
+		return nil, errors.New("integrity check failed")
+	}
+
+	return r, nil
+}
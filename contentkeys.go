@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ContentKeys maps the default_KID of a track to the key that decrypts it. Default is used for
+// every track without a key of its own, it is what a key store envelope (or a fest license with a
+// single key and no kid) unwraps to.
+type ContentKeys struct {
+	ByKID   map[string][]byte
+	Default []byte
+}
+
+func NewContentKeys() *ContentKeys {
+	return &ContentKeys{ByKID: make(map[string][]byte)}
+}
+
+// decodeKeyValue accepts hex (with or without dashes) and falls back to base64url.
+func decodeKeyValue(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+
+	if decoded, err := hex.DecodeString(strings.ReplaceAll(value, "-", "")); err == nil && len(decoded) > 0 {
+		return decoded, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(decoded) == 0 {
+		return nil, fmt.Errorf("%q is neither hex nor base64url", value)
+	}
+
+	return decoded, nil
+}
+
+func (keys *ContentKeys) Add(kid string, key []byte) {
+	keys.ByKID[normalizeKID(kid)] = key
+}
+
+// Key returns the key for a track, a track without a kid gets the only key when there is one.
+func (keys *ContentKeys) Key(kid string) []byte {
+	if keys == nil {
+		return nil
+	}
+
+	if key, ok := keys.ByKID[normalizeKID(kid)]; ok && len(kid) > 0 {
+		return key
+	}
+
+	if keys.Default != nil {
+		return keys.Default
+	}
+
+	if len(kid) == 0 && len(keys.ByKID) == 1 {
+		for _, key := range keys.ByKID {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// Has reports whether kid has a key of its own rather than falling back to the default.
+func (keys *ContentKeys) Has(kid string) bool {
+	if keys == nil || len(kid) == 0 {
+		return false
+	}
+
+	_, ok := keys.ByKID[normalizeKID(kid)]
+	return ok
+}
+
+func (keys *ContentKeys) Empty() bool {
+	return keys == nil || (len(keys.ByKID) == 0 && keys.Default == nil)
+}
+
+func (keys *ContentKeys) String() string {
+	if keys == nil {
+		return ""
+	}
+
+	var kids []string
+	for kid := range keys.ByKID {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	return strings.Join(kids, ",")
+}
+
+// Set parses a -key value, kid:key with both as hex.
+func (keys *ContentKeys) Set(value string) error {
+	kid, key, ok := strings.Cut(value, ":")
+	if !ok {
+		return errors.New("key must look like <kid>:<key>")
+	}
+
+	decodedkid, err := decodeKeyValue(kid)
+	if err != nil {
+		return fmt.Errorf("kid: %v", err)
+	}
+
+	decodedkey, err := decodeKeyValue(key)
+	if err != nil {
+		return fmt.Errorf("key: %v", err)
+	}
+
+	keys.Add(hex.EncodeToString(decodedkid), decodedkey)
+	return nil
+}
+
+type jsonWebKeySet struct {
+	Keys []struct {
+		K   string `json:"k"`
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+	} `json:"keys"`
+}
+
+// LoadFile adds the keys of a json web key set, the ClearKey license format, or of a text file with
+// one kid:key per line where empty lines and lines starting with # are skipped.
+func (keys *ContentKeys) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var keyset jsonWebKeySet
+		err = json.Unmarshal(data, &keyset)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		for idx, jwk := range keyset.Keys {
+			kid, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.Kid, "="))
+			if err != nil {
+				return fmt.Errorf("%s: key %d: kid: %v", path, idx, err)
+			}
+
+			key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+			if err != nil {
+				return fmt.Errorf("%s: key %d: k: %v", path, idx, err)
+			}
+
+			keys.Add(hex.EncodeToString(kid), key)
+		}
+
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for linenumber := 1; scanner.Scan(); linenumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		err = keys.Set(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, linenumber, err)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"blurlconvert/blurldecrypt"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The synthetic tracks are fragmented mp4s whose mdat payloads are aes-ctr encrypted with a zero iv.
+// The fake ffmpeg below undoes exactly that, so the output only matches when the right key made it
+// all the way through the pipeline.
+
+var testContentKey = [16]byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xba, 0xdc, 0xfe, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+const (
+	testKID      = "0d8b2a6e-4a1b-4c3f-9f2e-7b5d1c9e8a40"
+	testNonce    = "e2e-test-nonce"
+	testSegments = 3
+)
+
+func mp4box(boxtype string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box[0:4], uint32(8+len(payload)))
+	copy(box[4:8], boxtype)
+	return append(box, payload...)
+}
+
+func cryptMdat(key []byte, payload []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	out := make([]byte, len(payload))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, payload)
+	return out
+}
+
+// fragment is one moof (with only an mfhd) followed by its mdat.
+func fragment(sequence uint32, payload []byte) []byte {
+	mfhd := make([]byte, 8)
+	binary.BigEndian.PutUint32(mfhd[4:8], sequence)
+	return append(mp4box("moof", mp4box("mfhd", mfhd)), mp4box("mdat", payload)...)
+}
+
+type testTrack struct {
+	contentType    string
+	representation string
+	lang           string
+	init           []byte
+	samples        [][]byte
+}
+
+func newTestTrack(contentType string, representation string) testTrack {
+	track := testTrack{
+		contentType:    contentType,
+		representation: representation,
+		lang:           "en",
+		init:           append(mp4box("ftyp", []byte("iso6")), mp4box("moov", []byte(contentType+" "+representation+" track header"))...),
+	}
+
+	for idx := 0; idx < testSegments; idx++ {
+		track.samples = append(track.samples, []byte(fmt.Sprintf("%s %s sample %d %s", contentType, representation, idx+1, strings.Repeat(contentType[:1], 40+idx))))
+	}
+
+	return track
+}
+
+func (track testTrack) initName() string {
+	return fmt.Sprintf("init_t_%s.mp4", track.representation)
+}
+
+func (track testTrack) segment(idx int, key []byte) []byte {
+	return fragment(uint32(idx+1), cryptMdat(key, track.samples[idx]))
+}
+
+// decrypted is what the pipeline should produce for the track.
+func (track testTrack) decrypted() []byte {
+	out := append([]byte{}, track.init...)
+	for idx := range track.samples {
+		out = append(out, fragment(uint32(idx+1), track.samples[idx])...)
+	}
+	return out
+}
+
+func testMPDFor(baseurl string, tracks []testTrack) string {
+	var adaptations strings.Builder
+	for idx, track := range tracks {
+		fmt.Fprintf(&adaptations, `
+    <AdaptationSet id="%d" contentType="%s" lang="%s">
+      <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" default_KID="%s"/>
+      <Representation id="%s" bandwidth="128000" codecs="test.%s" audioSamplingRate="48000">
+        <SegmentTemplate duration="96000" timescale="48000" initialization="init_t_$RepresentationID$.mp4" media="segment_t_$RepresentationID$_$Number$.m4s" startNumber="1"/>
+      </Representation>
+    </AdaptationSet>`, idx, track.contentType, track.lang, testKID, track.representation, track.contentType)
+	}
+
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT%dS">
+  <BaseURL>%s/elsewhere/</BaseURL>
+  <Period id="0">%s
+  </Period>
+</MPD>`, testSegments*2, baseurl, adaptations.String())
+}
+
+// fakeCDN serves the manifest and every init and media segment of tracks next to it, files can be
+// replaced before the run to simulate a broken cdn. The BaseURL of the manifest points nowhere since
+// it is only followed for inline manifests.
+type fakeCDN struct {
+	*httptest.Server
+	mu       sync.Mutex
+	files    map[string][]byte
+	requests map[string]int
+}
+
+func newFakeCDN(t *testing.T, tracks []testTrack, key []byte) *fakeCDN {
+	cdn := &fakeCDN{files: make(map[string][]byte), requests: make(map[string]int)}
+
+	cdn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdn.mu.Lock()
+		data, ok := cdn.files[r.URL.Path]
+		cdn.requests[r.URL.Path]++
+		cdn.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(data)
+	}))
+	t.Cleanup(cdn.Close)
+
+	cdn.files["/media/master.mpd"] = []byte(testMPDFor(cdn.URL, tracks))
+
+	for _, track := range tracks {
+		cdn.files["/media/"+track.initName()] = track.init
+		for idx := range track.samples {
+			cdn.files["/media/"+GetSegmentName(track.initName(), track.representation, idx+1)] = track.segment(idx, key)
+		}
+	}
+
+	return cdn
+}
+
+func setForTest[T any](t *testing.T, target *T, value T) {
+	previous := *target
+	*target = value
+	t.Cleanup(func() { *target = previous })
+}
+
+// TestHelperProcess is the fake ffmpeg. With -decryption_key it decrypts the mdat payloads of its
+// input, with -f hls it cuts its input into an init and one segment per fragment and without either
+// it concatenates its inputs the way a merge would.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("BLURLCONVERT_FAKE_FFMPEG") != "1" {
+		return
+	}
+
+	if os.Getenv("BLURLCONVERT_FAKE_FFMPEG_FAIL") == "1" {
+		fmt.Fprintln(os.Stderr, "fake ffmpeg failure")
+		os.Exit(1)
+	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	// skip "--" and the program name
+	args = args[2:]
+
+	var key []byte
+	var inputs []string
+	options := make(map[string]string)
+	for idx := 0; idx < len(args)-1; idx++ {
+		switch args[idx] {
+		case "-y":
+		case "-decryption_key":
+			key, _ = hex.DecodeString(args[idx+1])
+			idx++
+		case "-i":
+			inputs = append(inputs, args[idx+1])
+			idx++
+		default:
+			if strings.HasPrefix(args[idx], "-") {
+				options[args[idx]] = args[idx+1]
+				idx++
+			}
+		}
+	}
+	output := args[len(args)-1]
+
+	if options["-f"] == "hls" {
+		err := fakeHLSMuxer(inputs[0], output, options["-hls_fmp4_init_filename"], options["-hls_segment_filename"])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var out []byte
+	for _, input := range inputs {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if key == nil {
+			out = append(out, data...)
+			continue
+		}
+
+		boxes, err := readBoxes(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		for _, box := range boxes {
+			payload := box.Payload
+			if box.Type == "mdat" {
+				payload = cryptMdat(key, payload)
+			}
+			out = append(out, mp4box(box.Type, payload)...)
+		}
+	}
+
+	err := os.WriteFile(output, out, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func fakeHLSMuxer(input string, playlist string, initname string, segmentpattern string) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return err
+	}
+
+	var init []byte
+	var segments [][]byte
+	for _, box := range boxes {
+		encoded := mp4box(box.Type, box.Payload)
+		switch {
+		case box.Type == "moof":
+			segments = append(segments, encoded)
+		case len(segments) == 0:
+			init = append(init, encoded...)
+		default:
+			segments[len(segments)-1] = append(segments[len(segments)-1], encoded...)
+		}
+	}
+
+	dir := filepath.Dir(playlist)
+
+	err = os.WriteFile(filepath.Join(dir, initname), init, 0644)
+	if err != nil {
+		return err
+	}
+
+	var m3u8 strings.Builder
+	fmt.Fprintf(&m3u8, "#EXTM3U\n#EXT-X-MAP:URI=\"%s\"\n", initname)
+	for idx, segment := range segments {
+		name := strings.Replace(segmentpattern, "%d", fmt.Sprint(idx), 1)
+		err = os.WriteFile(name, segment, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&m3u8, "#EXTINF:2.000,\n%s\n", filepath.Base(name))
+	}
+	m3u8.WriteString("#EXT-X-ENDLIST\n")
+
+	return os.WriteFile(playlist, []byte(m3u8.String()), 0644)
+}
+
+func fakeFFmpeg(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--", name}, args...)...)
+	cmd.Env = append(os.Environ(), "BLURLCONVERT_FAKE_FFMPEG=1")
+	return cmd
+}
+
+type e2eEnv struct {
+	dir    string
+	input  string
+	outdir string
+	cdn    *fakeCDN
+	tracks []testTrack
+}
+
+// setupE2E serves the given tracks (a video and an audio track by default) from a fake cdn, writes a
+// blurl pointing at it whose envelope unwraps to testContentKey through a generated keys.bin and
+// points every flag the run reads at a temporary directory.
+func setupE2E(t *testing.T, tracks ...testTrack) *e2eEnv {
+	env := &e2eEnv{dir: t.TempDir(), tracks: tracks}
+	env.outdir = filepath.Join(env.dir, "out")
+	if len(env.tracks) == 0 {
+		env.tracks = []testTrack{newTestTrack("video", "1"), newTestTrack("audio", "2")}
+	}
+	env.cdn = newFakeCDN(t, env.tracks, testContentKey[:])
+
+	storekey := [32]byte{0: 0xaa, 31: 0x55}
+	ev, record, err := blurldecrypt.BuildEV(testContentKey, testNonce, [4]byte{'t', 'e', 's', 't'}, storekey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keystore := filepath.Join(env.dir, "keys.bin")
+	err = os.WriteFile(keystore, record.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.input = filepath.Join(env.dir, "e2e.blurl")
+	err = os.WriteFile(env.input, encodeTestBLURL(t, BLURL{
+		Ev:        base64.StdEncoding.EncodeToString(ev),
+		Type:      "vod",
+		Playlists: []Playlist{{Language: "en", Type: "main", URL: env.cdn.URL + "/media/master.mpd"}},
+	}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the key stores a test passes with -keys are searched, never the developer's own
+	home := t.TempDir()
+	t.Setenv("BLURLCONVERT_KEYS", "")
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+	setForTest(t, &keyStoreCandidates, func(flagpaths []string) []string { return flagpaths })
+
+	setForTest(t, &ffmpegCommand, fakeFFmpeg)
+	setForTest(t, &keyPaths, pathListFlag{keystore})
+	setForTest(t, &contentKeys, NewContentKeys())
+	setForTest(t, noKeyCache, true)
+	setForTest(t, outputDir, env.outdir)
+	setForTest(t, workDir, "")
+	setForTest(t, nameTemplate, "")
+	setForTest(t, onCollision, "overwrite")
+	setForTest(t, checksums, false)
+	setForTest(t, emitHLS, false)
+	setForTest(t, &progress, nil)
+
+	return env
+}
+
+func (env *e2eEnv) expected() []byte {
+	var out []byte
+	for _, track := range env.tracks {
+		out = append(out, track.decrypted()...)
+	}
+	return out
+}
+
+func TestEndToEndDASH(t *testing.T) {
+	env := setupE2E(t)
+
+	result := NewRunResult(env.input)
+	err := run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Key != hex.EncodeToString(testContentKey[:]) {
+		t.Errorf("key %s, want %x", result.Key, testContentKey)
+	}
+
+	if result.Format != "dash" || result.SegmentCount != testSegments || len(result.Tracks) != 2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	if len(result.Outputs) != 1 {
+		t.Fatalf("got outputs %v, want the merged file", result.Outputs)
+	}
+
+	if filepath.Dir(result.Outputs[0]) != env.outdir {
+		t.Errorf("output %s is not in %s", result.Outputs[0], env.outdir)
+	}
+
+	got, err := os.ReadFile(result.Outputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, env.expected()) {
+		t.Fatalf("merged output does not match the decrypted tracks:\n got %q\nwant %q", got, env.expected())
+	}
+}
+
+func TestEndToEndEmitHLS(t *testing.T) {
+	env := setupE2E(t)
+	setForTest(t, emitHLS, true)
+
+	err := run(env.input, NewRunResult(env.input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hlsdir := filepath.Join(env.outdir, "hls")
+
+	keyfiles, _ := filepath.Glob(filepath.Join(hlsdir, "*.key"))
+	if len(keyfiles) != 0 {
+		t.Fatalf("key material was written to %v", keyfiles)
+	}
+
+	master, err := os.ReadFile(filepath.Join(hlsdir, "master.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(master), `AUDIO="audio-test.audio"`) || !strings.Contains(string(master), "video_1.m3u8") {
+		t.Fatalf("unexpected master playlist:\n%s", master)
+	}
+
+	// the packaged segments are the decrypted fragments of the track
+	for _, track := range env.tracks {
+		playlist, err := os.ReadFile(filepath.Join(hlsdir, fmt.Sprintf("%s_%s.m3u8", track.contentType, track.representation)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseHLSPlaylist(playlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(parsed.Segments) != testSegments {
+			t.Fatalf("%s has %d segments, want %d", track.contentType, len(parsed.Segments), testSegments)
+		}
+
+		for idx, segment := range parsed.Segments {
+			got, err := os.ReadFile(filepath.Join(hlsdir, segment.URI))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, fragment(uint32(idx+1), track.samples[idx])) {
+				t.Fatalf("%s segment %d is not decrypted", track.contentType, idx)
+			}
+		}
+	}
+
+	// a rerun replaces the playlists as a whole, or keeps them next to each other with suffix
+	result := NewRunResult(env.input)
+	err = run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.HLS != hlsdir {
+		t.Fatalf("hls written to %s, want %s", result.HLS, hlsdir)
+	}
+
+	setForTest(t, onCollision, "suffix")
+
+	result = NewRunResult(env.input)
+	err = run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.HLS != hlsdir+"_1" {
+		t.Fatalf("hls written to %s, want %s_1", result.HLS, hlsdir)
+	}
+
+	if _, err := os.Stat(filepath.Join(result.HLS, "master.m3u8")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEndToEndMultipleAudio(t *testing.T) {
+	french := newTestTrack("audio", "audio_fr")
+	french.lang = "fr"
+	env := setupE2E(t, newTestTrack("video", "video_1080"), newTestTrack("audio", "audio_en"), french)
+	setForTest(t, emitHLS, true)
+
+	result := NewRunResult(env.input)
+	err := run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two audio tracks can't be muxed with the video, so every track is kept on its own
+	if len(result.Outputs) != len(env.tracks) || len(result.Tracks) != len(env.tracks) {
+		t.Fatalf("got outputs %v, want one per track", result.Outputs)
+	}
+
+	hlsdir := filepath.Join(env.outdir, "hls")
+
+	for idx, track := range env.tracks {
+		if result.Tracks[idx].Language != track.lang {
+			t.Errorf("track %d has language %q, want %q", idx, result.Tracks[idx].Language, track.lang)
+		}
+
+		got, err := os.ReadFile(result.Tracks[idx].Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, track.decrypted()) {
+			t.Fatalf("%s output does not match its decrypted track", track.representation)
+		}
+
+		playlist, err := os.ReadFile(filepath.Join(hlsdir, fmt.Sprintf("%s_%s.m3u8", track.contentType, track.representation)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseHLSPlaylist(playlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segment, err := os.ReadFile(filepath.Join(hlsdir, parsed.Segments[0].URI))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(segment, fragment(1, track.samples[0])) {
+			t.Fatalf("the %s playlist packaged another track", track.representation)
+		}
+	}
+}
+
+func TestEndToEndRedactKey(t *testing.T) {
+	env := setupE2E(t)
+	setForTest(t, redactKey, true)
+
+	// the messages of the run are kept to look for the key
+	messages, err := os.Create(filepath.Join(env.dir, "messages.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer messages.Close()
+	setForTest(t, &os.Stdout, messages)
+
+	result := NewRunResult(env.input)
+	err = run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printed, err := os.ReadFile(messages.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(printed), hex.EncodeToString(testContentKey[:])) {
+		t.Fatalf("the key was printed:\n%s", printed)
+	}
+
+	if result.Key != "redacted" {
+		t.Fatalf("the key shows up as %s", result.Key)
+	}
+}
+
+func TestEndToEndKeyFlag(t *testing.T) {
+	env := setupE2E(t)
+
+	// a key given on the command line wins over the envelope, the key store isn't even needed
+	setForTest(t, &keyPaths, pathListFlag{filepath.Join(env.dir, "missing.bin")})
+	err := contentKeys.Set(strings.ReplaceAll(testKID, "-", "") + ":" + hex.EncodeToString(testContentKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := NewRunResult(env.input)
+	err = run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(result.Outputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, env.expected()) {
+		t.Fatal("merged output does not match the decrypted tracks")
+	}
+}
+
+func TestEndToEndKeyFlagOtherKID(t *testing.T) {
+	env := setupE2E(t)
+
+	// the only key given belongs to another kid, so the tracks can't be decrypted at all
+	err := contentKeys.Set("00112233445566778899aabbccddeeff:" + hex.EncodeToString(testContentKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = run(env.input, NewRunResult(env.input))
+	if err == nil || !strings.Contains(err.Error(), testKID) {
+		t.Fatalf("got %v, want an error naming the kid", err)
+	}
+
+	// the manifest names the kids, nothing else should be downloaded
+	if len(env.cdn.requests) != 1 || env.cdn.requests["/media/master.mpd"] != 1 {
+		t.Fatalf("the cdn was asked for %v before the keys were known", env.cdn.requests)
+	}
+}
+
+func TestEndToEndCorruptSegment(t *testing.T) {
+	env := setupE2E(t)
+	setForTest(t, emitHLS, true)
+
+	// the audio track breaks after the video track was already packaged for hls
+	name := "/media/" + GetSegmentName(env.tracks[1].initName(), env.tracks[1].representation, 2)
+	env.cdn.files[name] = env.cdn.files[name][:20]
+
+	err := run(env.input, NewRunResult(env.input))
+	if err == nil || !strings.Contains(err.Error(), "failed validation") {
+		t.Fatalf("got %v, want a validation error", err)
+	}
+
+	entries, _ := os.ReadDir(env.outdir)
+	if len(entries) != 0 {
+		t.Fatalf("a failed run left %d files in the output directory", len(entries))
+	}
+}
+
+func TestEndToEndFFmpegFailure(t *testing.T) {
+	env := setupE2E(t)
+	t.Setenv("BLURLCONVERT_FAKE_FFMPEG_FAIL", "1")
+
+	err := run(env.input, NewRunResult(env.input))
+	if err == nil || !strings.Contains(err.Error(), "ffmpeg failed to decrypt") {
+		t.Fatalf("got %v, want the decryption error", err)
+	}
+
+	entries, _ := os.ReadDir(env.outdir)
+	if len(entries) != 0 {
+		t.Fatalf("a failed decryption left %d files in the output directory", len(entries))
+	}
+}
+
+func TestEndToEndMissingKey(t *testing.T) {
+	env := setupE2E(t)
+
+	// check byte 0x3c, the test nonce would need 0x61 for this id
+	other := blurldecrypt.NewKeyRecord([4]byte{'o', 't', 'h', 'r'}, "some other nonce", [32]byte{})
+	if other.Matches(testNonce) {
+		t.Fatal("the other record matches the test nonce, pick another id or nonce")
+	}
+
+	keystore := filepath.Join(env.dir, "other.bin")
+	err := os.WriteFile(keystore, other.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &keyPaths, pathListFlag{keystore})
+
+	err = run(env.input, NewRunResult(env.input))
+	if err == nil || !strings.Contains(err.Error(), testNonce) {
+		t.Fatalf("got %v, want an error naming the nonce", err)
+	}
+
+	// the manifest is read for its kids, no segment should be downloaded
+	if len(env.cdn.requests) != 1 || env.cdn.requests["/media/master.mpd"] != 1 {
+		t.Fatalf("the cdn was asked for %v before the key was known", env.cdn.requests)
+	}
+}
+
+func TestEndToEndKeyCache(t *testing.T) {
+	env := setupE2E(t)
+
+	cachepath := filepath.Join(env.dir, "keycache.json")
+	setForTest(t, noKeyCache, false)
+	setForTest(t, keyCachePath, cachepath)
+
+	// a run that fails keeps its key out of the cache, even one given with -key
+	err := contentKeys.Set(strings.ReplaceAll(testKID, "-", "") + ":" + hex.EncodeToString(testContentKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "/media/" + GetSegmentName(env.tracks[0].initName(), env.tracks[0].representation, 2)
+	segment := env.cdn.files[name]
+	env.cdn.files[name] = segment[:20]
+
+	if err := run(env.input, NewRunResult(env.input)); err == nil {
+		t.Fatal("expected the corrupt segment to fail the run")
+	}
+
+	cache, err := LoadKeyCache(cachepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key := cache.ByKID(testKID); key != nil {
+		t.Fatalf("a failed run cached %x", key)
+	}
+
+	env.cdn.files[name] = segment
+	setForTest(t, &contentKeys, NewContentKeys())
+
+	if err := run(env.input, NewRunResult(env.input)); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a key store the envelope can't be unwrapped, the kid alone finds the key
+	setForTest(t, &keyPaths, pathListFlag{filepath.Join(env.dir, "missing.bin")})
+
+	result := NewRunResult(env.input)
+	err = run(env.input, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(result.Outputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, env.expected()) {
+		t.Fatal("merged output does not match the decrypted tracks")
+	}
+
+	// a bare manifest has no envelope at all
+	manifest := env.cdn.URL + "/media/master.mpd"
+
+	result = NewRunResult(manifest)
+	err = run(manifest, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Key != hex.EncodeToString(testContentKey[:]) {
+		t.Fatalf("key %s, want %x", result.Key, testContentKey)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"blurlconvert/blurldecrypt"
+	"blurlconvert/festdecrypt"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	envelopeKeyStore = "keystore"
+	envelopeFest     = "fest"
+)
+
+// detectEnvelope tells the two envelope variants apart. The key store variant starts with a version
+// known to blurldecrypt and is followed by a printable nonce whose length is in the third byte, the
+// iv the version needs and the wrapped key, trailing bytes are ignored like ParseEV does. The fest
+// variant starts with version 1, leaves the third byte unused and carries an aes-cbc encrypted
+// ClearKey license instead.
+func detectEnvelope(envelope []byte) (string, error) {
+	if len(envelope) == 0 {
+		return "", errors.New("empty envelope")
+	}
+
+	length, err := blurldecrypt.EnvelopeLength(envelope)
+	if err == nil && len(envelope) >= length && isPrintable(envelope[5:5+int(envelope[2])]) {
+		return envelopeKeyStore, nil
+	}
+
+	if envelope[0] != 1 {
+		return "", fmt.Errorf("unknown envelope version %d", envelope[0])
+	}
+
+	return envelopeFest, nil
+}
+
+func isPrintable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// bearerToken returns the token from -bearer, -bearer-file or BLURLCONVERT_BEARER in that order.
+func bearerToken(flagvalue string, file string) (string, error) {
+	if len(flagvalue) > 0 {
+		return strings.TrimSpace(flagvalue), nil
+	}
+
+	if len(file) > 0 {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return strings.TrimSpace(os.Getenv("BLURLCONVERT_BEARER")), nil
+}
+
+// unwrapFestEnvelope decrypts the fest envelope with the bearer token and adds every key of its
+// license to keys.
+func unwrapFestEnvelope(ev string, bearer string, keys *ContentKeys) error {
+	if len(bearer) == 0 {
+		return errors.New("this envelope needs a bearer token, pass one with -bearer, -bearer-file or BLURLCONVERT_BEARER")
+	}
+
+	contentkeys, err := festdecrypt.GetFestContentKeys(ev, bearer)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the envelope: %v", err)
+	}
+
+	return addLicenseKeys(keys, contentkeys)
+}
+
+// addLicenseKeys adds the keys of a fest license by kid. Only a license holding a single key without
+// a kid sets the default, a track whose kid the license doesn't list must not get an unrelated key.
+func addLicenseKeys(keys *ContentKeys, contentkeys []festdecrypt.ContentKey) error {
+	if len(contentkeys) == 0 {
+		return errors.New("the license holds no keys")
+	}
+
+	if len(contentkeys) == 1 && len(contentkeys[0].KID) == 0 {
+		keys.Default = contentkeys[0].Key
+		return nil
+	}
+
+	for _, contentkey := range contentkeys {
+		if len(contentkey.KID) > 0 {
+			keys.Add(hex.EncodeToString(contentkey.KID), contentkey.Key)
+			fmt.Printf("Key %x: %s\n", contentkey.KID, displayKey(contentkey.Key))
+		}
+	}
+
+	return nil
+}
+
+// unwrapKeyStoreEnvelope looks the envelope key up in the key stores (or the key cache) and returns
+// the content key along with the envelope nonce.
+func unwrapKeyStoreEnvelope(envelope []byte, keycache *KeyCache) ([]byte, string, error) {
+	parsedev, err := blurldecrypt.ParseEV(envelope)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error parsing EV: %v", err)
+	}
+
+	key := keycache.ByNonce(parsedev.Nonce)
+	if key != nil {
+		fmt.Println("Key found in cache")
+		return key, parsedev.Nonce, nil
+	}
+
+	keystores := findKeyStores(keyPaths)
+
+	key, err = blurldecrypt.FindEnvelopeKey(keystores, parsedev)
+
+	switch {
+	case errors.Is(err, blurldecrypt.ErrKeyStoreNotFound):
+		return nil, "", fmt.Errorf("no %s found, pass one with -keys or BLURLCONVERT_KEYS", keyStoreName)
+	case errors.Is(err, blurldecrypt.ErrNoMatchingKey):
+		return nil, "", fmt.Errorf("no key for nonce %q in %s", parsedev.Nonce, strings.Join(keystores, ", "))
+	case err != nil:
+		return nil, "", fmt.Errorf("failed to get the encryption key: %v", err)
+	}
+
+	return key, parsedev.Nonce, nil
+}
+
+// unwrapEnvelope routes the base64 envelope of a blurl to the matching decrypter, adds the keys it
+// unwraps to keys and returns the envelope nonce if it has one.
+func unwrapEnvelope(ev string, bearer string, keycache *KeyCache, keys *ContentKeys) (string, error) {
+	decodedEV, err := base64.StdEncoding.DecodeString(ev)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding base64: %v", err)
+	}
+
+	variant, err := detectEnvelope(decodedEV)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing EV: %v", err)
+	}
+
+	if variant == envelopeFest {
+		return "", unwrapFestEnvelope(ev, bearer, keys)
+	}
+
+	key, nonce, err := unwrapKeyStoreEnvelope(decodedEV, keycache)
+	if err != nil {
+		return "", err
+	}
+
+	keys.Default = key
+	return nonce, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"blurlconvert/blurldecrypt"
+	"blurlconvert/festdecrypt"
+	"bytes"
+	"testing"
+)
+
+func TestDetectEnvelope(t *testing.T) {
+	ev, _, err := blurldecrypt.BuildEV([16]byte{1}, "a-nonce", [4]byte{}, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// version 1, the unused third byte, subkey length 4 and ciphertext offset 0
+	fest := append([]byte{1, 0, 0, 4, 0}, make([]byte, 44)...)
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		want     string
+	}{
+		{"key store", ev, envelopeKeyStore},
+		{"key store with trailing bytes", append(append([]byte{}, ev...), 0, 0, 0, 0), envelopeKeyStore},
+		{"fest", fest, envelopeFest},
+		{"truncated key store", ev[:len(ev)-1], envelopeFest},
+	}
+
+	for _, test := range tests {
+		got, err := detectEnvelope(test.envelope)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	for _, invalid := range [][]byte{nil, {2, 0, 0, 0, 0}} {
+		if _, err := detectEnvelope(invalid); err == nil {
+			t.Errorf("%x: expected an error", invalid)
+		}
+	}
+}
+
+func TestAddLicenseKeys(t *testing.T) {
+	kid := []byte{0x0d, 0x8b, 0x2a, 0x6e, 0x4a, 0x1b, 0x4c, 0x3f, 0x9f, 0x2e, 0x7b, 0x5d, 0x1c, 0x9e, 0x8a, 0x40}
+	other := "00112233-4455-6677-8899-aabbccddeeff"
+	key := []byte("0123456789abcdef")
+
+	// a license naming its kid must not hand its key to a track with another kid
+	keys := NewContentKeys()
+	err := addLicenseKeys(keys, []festdecrypt.ContentKey{{KID: kid, Key: key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(keys.Key("0d8b2a6e-4a1b-4c3f-9f2e-7b5d1c9e8a40"), key) {
+		t.Fatal("the key isn't found by its kid")
+	}
+
+	if got := keys.Key(other); got != nil || keys.Has(other) {
+		t.Fatalf("a track with another kid got %x", got)
+	}
+
+	// only a single key without a kid applies to every track
+	keys = NewContentKeys()
+	err = addLicenseKeys(keys, []festdecrypt.ContentKey{{Key: key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(keys.Key(other), key) || keys.Has(other) {
+		t.Fatal("the single key isn't the default")
+	}
+
+	keys = NewContentKeys()
+	err = addLicenseKeys(keys, []festdecrypt.ContentKey{{Key: key}, {KID: kid, Key: key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys.Default != nil {
+		t.Fatal("a license with several keys set a default")
+	}
+
+	if err := addLicenseKeys(NewContentKeys(), nil); err == nil {
+		t.Fatal("expected an error for an empty license")
+	}
+}
@@ -11,69 +11,108 @@ import (
 	"strings"
 )
 
-func ParseJsonFromDecryptedBlob(blob string) string {
-	startIdx := strings.Index(blob, "{")
-	endIdx := strings.LastIndex(blob, "}")
+var (
+	ErrInvalidEnvelope      = errors.New("invalid envelope")
+	ErrEnvelopeTooShort     = errors.New("envelope is too short")
+	ErrInvalidHeader        = errors.New("envelope header is invalid")
+	ErrInvalidSubkeyLength  = errors.New("invalid bearer subkey length")
+	ErrBearerTooShort       = errors.New("bearer is shorter than the subkey")
+	ErrMisalignedCiphertext = errors.New("ciphertext is not a multiple of the block size")
+	ErrInvalidPadding       = errors.New("invalid padding")
+)
+
+const envelopeHeaderSize = 5
+
+// unpadPKCS7 strips the padding added before the license was encrypted.
+func unpadPKCS7(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidPadding, len(data))
+	}
+
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("%w: padding byte %d", ErrInvalidPadding, padding)
+	}
 
-	if startIdx == -1 || endIdx == -1 || endIdx < startIdx {
-		return blob
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("%w: inconsistent padding bytes", ErrInvalidPadding)
+		}
 	}
 
-	return blob[startIdx : endIdx+1]
+	return data[:len(data)-padding], nil
 }
 
-func decryptEnvelope(EVString string, Bearer string) (string, error) {
-	Envelope, err := base64.StdEncoding.DecodeString(EVString)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode envelope: %s", err)
+// decryptEnvelopeBytes decrypts a decoded envelope. The layout is a 5 byte header (version 1, two
+// unused bytes, the subkey length and the ciphertext offset) followed by the body. The last 16 -
+// subkey length bytes of the body are the start of the aes key, the rest of it is the last subkey
+// length bytes of the bearer. The ciphertext starts at the offset and runs up to that key part.
+func decryptEnvelopeBytes(envelope []byte, Bearer string) (string, error) {
+	if len(envelope) < envelopeHeaderSize {
+		return "", fmt.Errorf("%w: %d bytes", ErrEnvelopeTooShort, len(envelope))
 	}
 
-	if Envelope[0] != 1 {
-		return "", errors.New("envelope header is invalid")
+	if envelope[0] != 1 {
+		return "", fmt.Errorf("%w: version %d", ErrInvalidHeader, envelope[0])
 	}
 
-	fourthbyteofEnv := int(Envelope[3])
-	fifthbyteofEnv := int(Envelope[4])
+	subkeylength := int(envelope[3])
+	offset := int(envelope[4])
 
-	Envelope = Envelope[5:]
+	if subkeylength > aes.BlockSize {
+		return "", fmt.Errorf("%w: %d", ErrInvalidSubkeyLength, subkeylength)
+	}
 
-	if len(Bearer) >= fourthbyteofEnv {
-		subkey := []byte(Bearer[len(Bearer)-fourthbyteofEnv:])
+	if len(Bearer) < subkeylength {
+		return "", fmt.Errorf("%w: need %d bytes, got %d", ErrBearerTooShort, subkeylength, len(Bearer))
+	}
 
-		if len(subkey) == fourthbyteofEnv {
-			finalkey := append([]byte(Envelope[len(Envelope)-(0x10-fourthbyteofEnv):]), subkey...)
+	body := envelope[envelopeHeaderSize:]
+	keypartlength := aes.BlockSize - subkeylength
 
-			startIndex := fourthbyteofEnv + len(Envelope) - 0x10
-			endIndex := startIndex + (0x10 - fourthbyteofEnv)
+	if len(body) < keypartlength+offset {
+		return "", fmt.Errorf("%w: %d byte body", ErrEnvelopeTooShort, len(body))
+	}
 
-			Envelope = append(Envelope[:startIndex], Envelope[endIndex:]...)
+	finalkey := make([]byte, 0, aes.BlockSize)
+	finalkey = append(finalkey, body[len(body)-keypartlength:]...)
+	finalkey = append(finalkey, Bearer[len(Bearer)-subkeylength:]...)
 
-			if (len(Envelope)-fifthbyteofEnv)%16 == 0 {
-				encryptedIntArray := Envelope[fifthbyteofEnv:]
+	ciphertext := body[offset : len(body)-keypartlength]
 
-				IV := make([]byte, aes.BlockSize)
+	if len(ciphertext) == 0 {
+		return "", fmt.Errorf("%w: no ciphertext", ErrEnvelopeTooShort)
+	}
 
-				block, err := aes.NewCipher(finalkey)
-				if err != nil {
-					return "", err
-				}
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("%w: %d bytes", ErrMisalignedCiphertext, len(ciphertext))
+	}
 
-				if len(encryptedIntArray)%aes.BlockSize != 0 {
-					return "", err
-				}
+	block, err := aes.NewCipher(finalkey)
+	if err != nil {
+		return "", err
+	}
 
-				cipher.NewCBCDecrypter(block, IV).CryptBlocks(encryptedIntArray, encryptedIntArray)
+	IV := make([]byte, aes.BlockSize)
 
-				return ParseJsonFromDecryptedBlob(string(encryptedIntArray)), nil
-			}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, IV).CryptBlocks(plaintext, ciphertext)
 
-		} else {
-			return "", errors.New("invalid bearer subkey length")
-		}
+	plaintext, err = unpadPKCS7(plaintext)
+	if err != nil {
+		return "", err
 	}
 
-	return "", nil
+	return string(plaintext), nil
+}
 
+func decryptEnvelope(EVString string, Bearer string) (string, error) {
+	Envelope, err := base64.StdEncoding.DecodeString(EVString)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to decode envelope: %v", ErrInvalidEnvelope, err)
+	}
+
+	return decryptEnvelopeBytes(Envelope, Bearer)
 }
 
 type CDMJson struct {
@@ -94,36 +133,67 @@ func addBase64Padding(b64blob []byte) string {
 	return string(b64blob)
 }
 
-func GetFestEncryptionKey(EVString string, Bearer string) (string, error) {
+// ContentKey is one entry of the ClearKey license inside the envelope.
+type ContentKey struct {
+	KID []byte
+	Key []byte
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	value = strings.ReplaceAll(value, "-", "+")
+	value = strings.ReplaceAll(value, "_", "/")
+
+	return base64.StdEncoding.DecodeString(addBase64Padding([]byte(value)))
+}
+
+// GetFestContentKeys decrypts the envelope and returns every key of the license with its kid.
+func GetFestContentKeys(EVString string, Bearer string) ([]ContentKey, error) {
 	var cdmobj CDMJson
 
 	strevobj, err := decryptEnvelope(EVString, Bearer)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	err = json.Unmarshal([]byte(strevobj), &cdmobj)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(cdmobj.Keys) == 0 {
-		return "", errors.New("no keys found in ev blob")
+		return nil, errors.New("no keys found in ev blob")
 	}
 
-	key := cdmobj.Keys[0].K
+	var keys []ContentKey
 
-	key = strings.ReplaceAll(key, "-", "+")
-	key = strings.ReplaceAll(key, "_", "/")
+	for idx, cdmkey := range cdmobj.Keys {
+		decodedKey, err := decodeBase64URL(cdmkey.K)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %d: %v", idx, err)
+		}
 
-	decodedKey, err := base64.StdEncoding.DecodeString(addBase64Padding([]byte(key)))
-	if err != nil {
-		return "", fmt.Errorf("failed to decode key %v", err)
+		var decodedKid []byte
+		if len(cdmkey.Kid) > 0 {
+			decodedKid, err = decodeBase64URL(cdmkey.Kid)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode kid %d: %v", idx, err)
+			}
+		}
+
+		keys = append(keys, ContentKey{KID: decodedKid, Key: decodedKey})
 	}
 
-	key = hex.EncodeToString(decodedKey)
+	return keys, nil
+}
+
+// GetFestEncryptionKey returns the first key of the envelope as hex.
+func GetFestEncryptionKey(EVString string, Bearer string) (string, error) {
+	keys, err := GetFestContentKeys(EVString, Bearer)
+	if err != nil {
+		return "", err
+	}
 
-	return key, nil
+	return hex.EncodeToString(keys[0].Key), nil
 }
@@ -0,0 +1,158 @@
+package festdecrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+const testLicense = `{"keys":[{"kty":"oct","kid":"q83vEjRWeJCrze8SNFZ4kA","k":"ABEiM0RVZneImaq7zN3u_w"},{"kty":"oct","kid":"AAAAAAAAAAAAAAAAAAAAAQ","k":"_____________________w"}]}`
+
+// buildTestEnvelope encrypts license the way decryptEnvelopeBytes expects it.
+func buildTestEnvelope(t testing.TB, license []byte, bearer string, subkeylength int, prefix []byte) []byte {
+	t.Helper()
+
+	keypart := bytes.Repeat([]byte{0x42}, aes.BlockSize-subkeylength)
+	key := append(append([]byte{}, keypart...), bearer[len(bearer)-subkeylength:]...)
+
+	padding := aes.BlockSize - len(license)%aes.BlockSize
+	plaintext := append(append([]byte{}, license...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(ciphertext, plaintext)
+
+	envelope := []byte{1, 0, 0, byte(subkeylength), byte(len(prefix))}
+	envelope = append(envelope, prefix...)
+	envelope = append(envelope, ciphertext...)
+	return append(envelope, keypart...)
+}
+
+func TestDecryptEnvelope(t *testing.T) {
+	bearer := "eyJhbGciOiJIUzI1NiJ9.payload.signature"
+
+	for _, subkeylength := range []int{0, 1, 8, 15, 16} {
+		envelope := buildTestEnvelope(t, []byte(testLicense), bearer, subkeylength, []byte{7, 7, 7})
+
+		license, err := decryptEnvelope(base64.StdEncoding.EncodeToString(envelope), bearer)
+		if err != nil {
+			t.Fatalf("subkey length %d: %v", subkeylength, err)
+		}
+
+		if license != testLicense {
+			t.Fatalf("subkey length %d: got %q", subkeylength, license)
+		}
+	}
+}
+
+func TestDecryptEnvelopeErrors(t *testing.T) {
+	bearer := "bearer-token"
+	valid := buildTestEnvelope(t, []byte(testLicense), bearer, 6, nil)
+
+	misaligned := append([]byte{}, valid...)
+	misaligned[4] = 3
+
+	badpadding := buildTestEnvelope(t, []byte(testLicense), bearer, 6, nil)
+	// flipping the last ciphertext byte garbles the final block and with it the padding
+	badpadding[len(badpadding)-(aes.BlockSize-6)-1] ^= 0xff
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		bearer   string
+		err      error
+	}{
+		{"empty", nil, bearer, ErrEnvelopeTooShort},
+		{"header only", []byte{1, 0, 0}, bearer, ErrEnvelopeTooShort},
+		{"version", []byte{2, 0, 0, 0, 0}, bearer, ErrInvalidHeader},
+		{"subkey length", []byte{1, 0, 0, 17, 0}, bearer, ErrInvalidSubkeyLength},
+		{"short bearer", valid, "abc", ErrBearerTooShort},
+		{"no body", []byte{1, 0, 0, 6, 0}, bearer, ErrEnvelopeTooShort},
+		{"offset past body", append([]byte{1, 0, 0, 0, 200}, make([]byte, 32)...), bearer, ErrEnvelopeTooShort},
+		{"no ciphertext", append([]byte{1, 0, 0, 0, 0}, make([]byte, 16)...), bearer, ErrEnvelopeTooShort},
+		{"misaligned", misaligned, bearer, ErrMisalignedCiphertext},
+		{"padding", badpadding, bearer, ErrInvalidPadding},
+	}
+
+	for _, test := range tests {
+		_, err := decryptEnvelopeBytes(test.envelope, test.bearer)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	_, err := decryptEnvelope("not base64!", bearer)
+	if !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("base64: got %v, want %v", err, ErrInvalidEnvelope)
+	}
+}
+
+func TestGetFestContentKeys(t *testing.T) {
+	bearer := "bearer-token"
+	ev := base64.StdEncoding.EncodeToString(buildTestEnvelope(t, []byte(testLicense), bearer, 6, nil))
+
+	keys, err := GetFestContentKeys(ev, bearer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ kid, key string }{
+		{"abcdef1234567890abcdef1234567890", "00112233445566778899aabbccddeeff"},
+		{"00000000000000000000000000000001", "ffffffffffffffffffffffffffffffff"},
+	}
+
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+
+	for idx := range want {
+		if hex.EncodeToString(keys[idx].KID) != want[idx].kid || hex.EncodeToString(keys[idx].Key) != want[idx].key {
+			t.Errorf("key %d: got %x:%x", idx, keys[idx].KID, keys[idx].Key)
+		}
+	}
+
+	first, err := GetFestEncryptionKey(ev, bearer)
+	if err != nil || first != want[0].key {
+		t.Errorf("GetFestEncryptionKey: got %q, %v", first, err)
+	}
+}
+
+func FuzzDecryptEnvelope(f *testing.F) {
+	bearer := "eyJhbGciOiJIUzI1NiJ9.payload.signature"
+
+	f.Add(buildTestEnvelope(f, []byte(testLicense), bearer, 6, nil), bearer)
+	f.Add(buildTestEnvelope(f, []byte("{}"), bearer, 0, []byte{1, 2}), bearer)
+	f.Add(buildTestEnvelope(f, []byte("{}"), bearer, 16, nil), bearer)
+	f.Add([]byte{1, 0, 0, 16, 255}, "")
+	f.Add([]byte{1}, "x")
+	f.Add([]byte{}, "")
+
+	f.Fuzz(func(t *testing.T, envelope []byte, bearer string) {
+		original := append([]byte{}, envelope...)
+
+		license, err := decryptEnvelopeBytes(envelope, bearer)
+		if err != nil {
+			if len(license) != 0 {
+				t.Fatalf("error %v came with a license", err)
+			}
+			return
+		}
+
+		if !bytes.Equal(envelope, original) {
+			t.Fatal("the envelope was modified")
+		}
+
+		// a license always comes out of at least one block minus its padding
+		if len(license) >= len(envelope) {
+			t.Fatalf("%d byte license from a %d byte envelope", len(license), len(envelope))
+		}
+	})
+}
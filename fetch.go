@@ -0,0 +1,394 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fetcher loads manifests, keys and segments. Non http implementations answer with synthesized
+// responses so callers can treat every backend the same way.
+type Fetcher interface {
+	Fetch(req *http.Request) (*http.Response, error)
+}
+
+var (
+	fetchersMu sync.RWMutex
+	fetchers   = map[string]Fetcher{
+		"http":  &HTTPFetcher{Client: http.DefaultClient},
+		"https": &HTTPFetcher{Client: http.DefaultClient},
+		"file":  FileFetcher{},
+	}
+)
+
+func init() {
+	mime.AddExtensionType(".mpd", "application/dash+xml")
+	mime.AddExtensionType(".m3u8", "application/vnd.apple.mpegurl")
+	mime.AddExtensionType(".m4s", "video/iso.segment")
+}
+
+// RegisterFetcher makes fetcher handle every url with the given scheme.
+func RegisterFetcher(scheme string, fetcher Fetcher) {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+
+	fetchers[strings.ToLower(scheme)] = fetcher
+}
+
+func fetcherFor(u *url.URL) (Fetcher, error) {
+	fetchersMu.RLock()
+	defer fetchersMu.RUnlock()
+
+	fetcher, ok := fetchers[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("no fetcher for url scheme %q", u.Scheme)
+	}
+
+	return fetcher, nil
+}
+
+func doFetch(req *http.Request) (*http.Response, error) {
+	fetcher, err := fetcherFor(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetcher.Fetch(req)
+}
+
+func fetchURL(rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return doFetch(req)
+}
+
+func newResponse(req *http.Request, body io.ReadCloser, size int64, name string) *http.Response {
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}
+
+	// range headers are ignored, callers slice full 200 responses themselves
+	resp.Header.Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+
+	return resp
+}
+
+func notFoundResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "404 Not Found",
+		StatusCode: http.StatusNotFound,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
+
+func openFileResponse(req *http.Request, localpath string) (*http.Response, error) {
+	file, err := os.Open(localpath)
+	if os.IsNotExist(err) {
+		return notFoundResponse(req), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		file.Close()
+		return notFoundResponse(req), nil
+	}
+
+	return newResponse(req, file, info.Size(), localpath), nil
+}
+
+type HTTPFetcher struct {
+	Client    *http.Client
+	Headers   map[string]string
+	UserAgent string
+}
+
+func (fetcher *HTTPFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	if len(fetcher.Headers) > 0 || len(fetcher.UserAgent) > 0 {
+		req = req.Clone(req.Context())
+
+		for name, value := range fetcher.Headers {
+			req.Header.Set(name, value)
+		}
+
+		if len(fetcher.UserAgent) > 0 {
+			req.Header.Set("User-Agent", fetcher.UserAgent)
+		}
+	}
+
+	return fetcher.Client.Do(req)
+}
+
+// FileFetcher serves file:// urls straight from disk.
+type FileFetcher struct{}
+
+func (FileFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	return openFileResponse(req, filepath.FromSlash(req.URL.Path))
+}
+
+// MirrorFetcher serves urls from a directory laid out as <dir>/<host>/<path> by the mirror command.
+type MirrorFetcher struct {
+	Dir string
+}
+
+func (fetcher *MirrorFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	localpath, err := MirrorPath(fetcher.Dir, req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return openFileResponse(req, localpath)
+}
+
+// MemoryFetcher serves the bodies of a fixed set of urls, mostly useful for tests.
+type MemoryFetcher map[string][]byte
+
+func (fetcher MemoryFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	body, ok := fetcher[u.String()]
+	if !ok {
+		return notFoundResponse(req), nil
+	}
+
+	return newResponse(req, io.NopCloser(bytes.NewReader(body)), int64(len(body)), u.Path), nil
+}
+
+// ArchiveFetcher serves urls from a tar or zip of a mirror directory. The archive may contain
+// the mirror directory itself so entries are matched on their <host>/<path> suffix.
+type ArchiveFetcher struct {
+	entries map[string]func() (io.ReadCloser, int64, error)
+	closer  io.Closer
+}
+
+func (fetcher *ArchiveFetcher) add(name string, open func() (io.ReadCloser, int64, error)) {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	fetcher.entries[name] = open
+}
+
+// lookup prefers the entry named exactly key. Otherwise the entry ending in /key with the shortest
+// prefix wins, ties go to the first name in sorted order so the same archive always serves the same file.
+func (fetcher *ArchiveFetcher) lookup(key string) func() (io.ReadCloser, int64, error) {
+	if open, ok := fetcher.entries[key]; ok {
+		return open
+	}
+
+	best := ""
+	for name := range fetcher.entries {
+		if !strings.HasSuffix(name, "/"+key) {
+			continue
+		}
+
+		if len(best) == 0 || len(name) < len(best) || (len(name) == len(best) && name < best) {
+			best = name
+		}
+	}
+
+	if len(best) == 0 {
+		return nil
+	}
+
+	return fetcher.entries[best]
+}
+
+func (fetcher *ArchiveFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	key := strings.TrimPrefix(path.Clean("/"+req.URL.Host+"/"+req.URL.Path), "/")
+
+	open := fetcher.lookup(key)
+	if open == nil {
+		return notFoundResponse(req), nil
+	}
+
+	body, size, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	return newResponse(req, body, size, key), nil
+}
+
+func (fetcher *ArchiveFetcher) Close() error {
+	if fetcher.closer == nil {
+		return nil
+	}
+	return fetcher.closer.Close()
+}
+
+func openZipFetcher(archivepath string) (*ArchiveFetcher, error) {
+	archive, err := zip.OpenReader(archivepath)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := &ArchiveFetcher{entries: make(map[string]func() (io.ReadCloser, int64, error)), closer: archive}
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		file := file
+		fetcher.add(file.Name, func() (io.ReadCloser, int64, error) {
+			body, err := file.Open()
+			return body, int64(file.UncompressedSize64), err
+		})
+	}
+
+	return fetcher, nil
+}
+
+// tempDir is removed when the fetcher holding it is closed.
+type tempDir string
+
+func (dir tempDir) Close() error {
+	return os.RemoveAll(string(dir))
+}
+
+func openTarFetcher(archivepath string) (*ArchiveFetcher, error) {
+	file, err := os.Open(archivepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+
+	if strings.HasSuffix(archivepath, ".gz") || strings.HasSuffix(archivepath, ".tgz") {
+		decompressor, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer decompressor.Close()
+
+		reader = decompressor
+	}
+
+	// tar has no index to seek with so the entries are extracted to a temporary directory, named by
+	// their position so no entry name can point outside of it
+	extractdir, err := os.MkdirTemp("", "blurlconvert-offline-*")
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := &ArchiveFetcher{entries: make(map[string]func() (io.ReadCloser, int64, error)), closer: tempDir(extractdir)}
+
+	err = extractTar(tar.NewReader(reader), extractdir, fetcher)
+	if err != nil {
+		fetcher.Close()
+		return nil, err
+	}
+
+	return fetcher, nil
+}
+
+func extractTar(archive *tar.Reader, dir string, fetcher *ArchiveFetcher) error {
+	for idx := 0; ; idx++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		extracted := filepath.Join(dir, strconv.Itoa(idx))
+
+		out, err := os.Create(extracted)
+		if err != nil {
+			return err
+		}
+
+		size, err := io.Copy(out, archive)
+		out.Close()
+		if err != nil {
+			return err
+		}
+
+		fetcher.add(header.Name, func() (io.ReadCloser, int64, error) {
+			body, err := os.Open(extracted)
+			return body, size, err
+		})
+	}
+}
+
+// NewOfflineFetcher serves a mirror from a directory, a .zip or a .tar(.gz) archive. Archive
+// fetchers hold the open zip or the extracted tar until they are closed.
+func NewOfflineFetcher(source string) (Fetcher, error) {
+	switch {
+	case strings.HasSuffix(source, ".zip"):
+		return openZipFetcher(source)
+	case strings.HasSuffix(source, ".tar"), strings.HasSuffix(source, ".tar.gz"), strings.HasSuffix(source, ".tgz"):
+		return openTarFetcher(source)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory or a tar/zip archive", source)
+	}
+
+	return &MirrorFetcher{Dir: source}, nil
+}
+
+// MirrorPath maps a url onto <dir>/<host>/<path> the same way the mirror command lays out the cdn.
+func MirrorPath(dir string, rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	if len(u.Host) == 0 {
+		return "", fmt.Errorf("url %q has no host", rawurl)
+	}
+
+	cleaned := path.Clean("/" + u.Path)
+	if cleaned == "/" {
+		return "", fmt.Errorf("url %q has no path", rawurl)
+	}
+
+	return filepath.Join(dir, u.Host, filepath.FromSlash(cleaned)), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// registerTestFetcher registers fetcher for the duration of the test and puts back whatever handled
+// the scheme before.
+func registerTestFetcher(t *testing.T, scheme string, fetcher Fetcher) {
+	fetchersMu.RLock()
+	previous, ok := fetchers[scheme]
+	fetchersMu.RUnlock()
+
+	RegisterFetcher(scheme, fetcher)
+
+	t.Cleanup(func() {
+		if ok {
+			RegisterFetcher(scheme, previous)
+			return
+		}
+
+		fetchersMu.Lock()
+		delete(fetchers, scheme)
+		fetchersMu.Unlock()
+	})
+}
+
+func TestFetchManifestStatus(t *testing.T) {
+	registerTestFetcher(t, "manifesttest", MemoryFetcher{"manifesttest://cdn/master.mpd": []byte(testMPD)})
+
+	body, _, err := fetchManifest("manifesttest://cdn/master.mpd")
+	if err != nil || string(body) != testMPD {
+		t.Fatalf("got %q, %v", body, err)
+	}
+
+	_, _, err = fetchManifest("manifesttest://cdn/missing.mpd")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("got %v, want an error with the status", err)
+	}
+}
+
+func TestArchiveFetcherLookup(t *testing.T) {
+	fetcher := &ArchiveFetcher{entries: make(map[string]func() (io.ReadCloser, int64, error))}
+
+	for _, name := range []string{"b/mirror/cdn/a.m4s", "mirror/cdn/a.m4s", "a/mirror/cdn/a.m4s", "cdn/b.m4s", "x/cdn/b.m4s", "b/cdn/d.m4s", "a/cdn/d.m4s"} {
+		name := name
+		fetcher.add(name, func() (io.ReadCloser, int64, error) {
+			return io.NopCloser(strings.NewReader(name)), int64(len(name)), nil
+		})
+	}
+
+	tests := map[string]string{
+		"cdn/a.m4s": "mirror/cdn/a.m4s",
+		"cdn/b.m4s": "cdn/b.m4s",
+		"cdn/d.m4s": "a/cdn/d.m4s",
+		"cdn/c.m4s": "",
+	}
+
+	for key, want := range tests {
+		// map iteration order changes between runs, so ask a few times
+		for i := 0; i < 20; i++ {
+			open := fetcher.lookup(key)
+			if open == nil {
+				if len(want) > 0 {
+					t.Fatalf("%s: found nothing, want %s", key, want)
+				}
+				break
+			}
+
+			body, _, _ := open()
+			got, _ := io.ReadAll(body)
+			if string(got) != want {
+				t.Fatalf("%s: got %s, want %s", key, got, want)
+			}
+		}
+	}
+}
+
+func TestTarFetcher(t *testing.T) {
+	archivepath := filepath.Join(t.TempDir(), "mirror.tar")
+
+	file, err := os.Create(archivepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := tar.NewWriter(file)
+	for name, body := range map[string]string{"mirror/cdn/a.m4s": "segment a", "mirror/cdn/b.m4s": "segment b"} {
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+		archive.Write([]byte(body))
+	}
+	archive.Close()
+	file.Close()
+
+	fetcher, err := openTarFetcher(archivepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://cdn/b.m4s", nil)
+	resp, err := fetcher.Fetch(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "segment b" || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("got %q (%d bytes)", body, resp.ContentLength)
+	}
+
+	// the extracted entries live on disk until the fetcher is closed
+	extractdir := string(fetcher.closer.(tempDir))
+
+	err = fetcher.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(extractdir); !os.IsNotExist(err) {
+		t.Fatalf("%s is still there after Close", extractdir)
+	}
+}
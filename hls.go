@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type HLSTrack struct {
+	ContentType     string
+	Language        string
+	Codecs          string
+	Bandwidth       int64
+	Playlist        string
+	SegmentDuration float64
+}
+
+func NewHLSTrack(mpddata *MPD, adaptationidx int) (HLSTrack, error) {
+	adaptation := mpddata.Period.AdaptationSet[adaptationidx]
+	representation := adaptation.Representation[0]
+
+	segmentDuration, err := strconv.ParseFloat(representation.SegmentTemplate.Duration, 64)
+	if err != nil {
+		return HLSTrack{}, fmt.Errorf("failed to parse segment duration: %v", err)
+	}
+
+	timescale, err := strconv.ParseFloat(representation.SegmentTemplate.Timescale, 64)
+	if err != nil || timescale == 0 {
+		return HLSTrack{}, fmt.Errorf("invalid timescale %q", representation.SegmentTemplate.Timescale)
+	}
+
+	bandwidth, _ := strconv.ParseInt(representation.Bandwidth, 10, 64)
+
+	return HLSTrack{
+		ContentType:     adaptation.ContentType,
+		Language:        adaptation.Lang,
+		Codecs:          representation.Codecs,
+		Bandwidth:       bandwidth,
+		Playlist:        fmt.Sprintf("%s_%s.m3u8", adaptation.ContentType, representation.ID),
+		SegmentDuration: segmentDuration / timescale,
+	}, nil
+}
+
+func (track *HLSTrack) groupID() string {
+	return fmt.Sprintf("%s-%s", track.ContentType, track.Codecs)
+}
+
+// PackageHLSTrack cuts the decrypted output of a track back into fMP4 segments of the original
+// duration and writes its media playlist, so nothing in dir is encrypted and no key is needed.
+func PackageHLSTrack(dir string, track *HLSTrack, input string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSuffix(track.Playlist, ".m3u8")
+
+	cmd := ffmpegCommand("ffmpeg", "-y", "-i", input, "-c", "copy", "-f", "hls",
+		"-hls_time", strconv.FormatFloat(track.SegmentDuration, 'f', 3, 64),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", name+"_init.mp4",
+		"-hls_segment_filename", filepath.Join(dir, name+"_%d.m4s"),
+		filepath.Join(dir, track.Playlist))
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed to package %s: %v", input, err)
+	}
+
+	return nil
+}
+
+func WriteHLSMasterPlaylist(dir string, tracks []HLSTrack) error {
+	var playlist strings.Builder
+	var audiotracks, videotracks []*HLSTrack
+
+	for idx := range tracks {
+		switch tracks[idx].ContentType {
+		case "audio":
+			audiotracks = append(audiotracks, &tracks[idx])
+		case "video":
+			videotracks = append(videotracks, &tracks[idx])
+		}
+	}
+
+	if len(audiotracks) == 0 && len(videotracks) == 0 {
+		return fmt.Errorf("no audio or video tracks to write a master playlist for")
+	}
+
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:7\n")
+	playlist.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	// audio only content has nothing to group the renditions under so every audio track is its own variant
+	if len(videotracks) == 0 {
+		for _, audio := range audiotracks {
+			playlist.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n%s\n", audio.Bandwidth, audio.Codecs, audio.Playlist))
+		}
+		return os.WriteFile(path.Join(dir, "master.m3u8"), []byte(playlist.String()), 0644)
+	}
+
+	// every distinct codec is its own audio group, each video track gets a variant per group
+	var groups []string
+	groupbandwidth := make(map[string]int64)
+	groupcodecs := make(map[string]string)
+
+	for idx, audio := range audiotracks {
+		group := audio.groupID()
+
+		isdefault := "NO"
+		if _, ok := groupcodecs[group]; !ok {
+			groups = append(groups, group)
+			groupcodecs[group] = audio.Codecs
+			isdefault = "YES"
+		}
+
+		if audio.Bandwidth > groupbandwidth[group] {
+			groupbandwidth[group] = audio.Bandwidth
+		}
+
+		name := audio.Language
+		if len(name) == 0 {
+			name = fmt.Sprintf("audio_%d", idx+1)
+		}
+
+		playlist.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",", group, name))
+		if len(audio.Language) > 0 {
+			playlist.WriteString(fmt.Sprintf("LANGUAGE=\"%s\",", audio.Language))
+		}
+		playlist.WriteString(fmt.Sprintf("DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"\n", isdefault, audio.Playlist))
+	}
+
+	for _, video := range videotracks {
+		if len(groups) == 0 {
+			playlist.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n%s\n", video.Bandwidth, video.Codecs, video.Playlist))
+			continue
+		}
+
+		for _, group := range groups {
+			playlist.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s,%s\",AUDIO=\"%s\"\n%s\n", video.Bandwidth+groupbandwidth[group], video.Codecs, groupcodecs[group], group, video.Playlist))
+		}
+	}
+
+	return os.WriteFile(path.Join(dir, "master.m3u8"), []byte(playlist.String()), 0644)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteHLSMasterPlaylist(t *testing.T) {
+	dir := t.TempDir()
+
+	tracks := []HLSTrack{
+		{ContentType: "video", Codecs: "avc1.64001f", Bandwidth: 1000000, Playlist: "video_1.m3u8"},
+		{ContentType: "audio", Codecs: "mp4a.40.2", Language: "en", Bandwidth: 128000, Playlist: "audio_2.m3u8"},
+		{ContentType: "audio", Codecs: "mp4a.40.2", Language: "de", Bandwidth: 96000, Playlist: "audio_3.m3u8"},
+		{ContentType: "audio", Codecs: "ec-3", Language: "en", Bandwidth: 384000, Playlist: "audio_4.m3u8"},
+	}
+
+	err := WriteHLSMasterPlaylist(dir, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := string(data)
+
+	for _, want := range []string{
+		`GROUP-ID="audio-mp4a.40.2",NAME="en",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="audio_2.m3u8"`,
+		`GROUP-ID="audio-mp4a.40.2",NAME="de",LANGUAGE="de",DEFAULT=NO,AUTOSELECT=YES,URI="audio_3.m3u8"`,
+		`GROUP-ID="audio-ec-3",NAME="en",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="audio_4.m3u8"`,
+		"#EXT-X-STREAM-INF:BANDWIDTH=1128000,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"audio-mp4a.40.2\"\nvideo_1.m3u8\n",
+		"#EXT-X-STREAM-INF:BANDWIDTH=1384000,CODECS=\"avc1.64001f,ec-3\",AUDIO=\"audio-ec-3\"\nvideo_1.m3u8\n",
+	} {
+		if !strings.Contains(master, want) {
+			t.Errorf("master playlist is missing %q:\n%s", want, master)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HTTPConfig struct {
+	Headers        map[string]string `json:"headers"`
+	UserAgent      string            `json:"user_agent"`
+	CookieFile     string            `json:"cookie_file"`
+	Proxy          string            `json:"proxy"`
+	CABundle       string            `json:"ca_bundle"`
+	Timeout        string            `json:"timeout"`
+	ConnectTimeout string            `json:"connect_timeout"`
+}
+
+func LoadHTTPConfig(filepath string) (HTTPConfig, error) {
+	var config HTTPConfig
+
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse http config %s: %v", filepath, err)
+	}
+
+	return config, nil
+}
+
+// loadCookieFile reads a netscape cookies.txt as exported by browsers and curl.
+func loadCookieFile(jar *cookiejar.Jar, filepath string) error {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cookies := make(map[string][]*http.Cookie)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		httponly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("invalid cookie line %q", line)
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		secure := strings.EqualFold(fields[3], "TRUE")
+
+		cookie := &http.Cookie{
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httponly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+
+		// host only cookies must not carry a domain or the jar widens them to subdomains
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err == nil && expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+
+		origin := fmt.Sprintf("%s://%s", scheme, domain)
+		cookies[origin] = append(cookies[origin], cookie)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for origin, originCookies := range cookies {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return err
+		}
+		jar.SetCookies(u, originCookies)
+	}
+
+	return nil
+}
+
+func NewHTTPFetcher(config HTTPConfig) (*HTTPFetcher, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	if len(config.ConnectTimeout) > 0 {
+		timeout, err := time.ParseDuration(config.ConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect timeout: %v", err)
+		}
+		dialer.Timeout = timeout
+		transport.TLSHandshakeTimeout = timeout
+	}
+
+	transport.DialContext = dialer.DialContext
+
+	// without an explicit proxy HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment still apply
+	if len(config.Proxy) > 0 {
+		proxyurl, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+
+		switch proxyurl.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyurl.Scheme)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyurl)
+	}
+
+	if len(config.CABundle) > 0 {
+		pem, err := os.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CABundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	client := &http.Client{Transport: transport}
+
+	if len(config.Timeout) > 0 {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %v", err)
+		}
+		client.Timeout = timeout
+	}
+
+	if len(config.CookieFile) > 0 {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		err = loadCookieFile(jar, config.CookieFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cookies: %v", err)
+		}
+
+		client.Jar = jar
+	}
+
+	return &HTTPFetcher{
+		Client:    client,
+		Headers:   config.Headers,
+		UserAgent: config.UserAgent,
+	}, nil
+}
+
+type headerFlag map[string]string
+
+func (headers headerFlag) String() string {
+	var pairs []string
+	for name, value := range headers {
+		pairs = append(pairs, fmt.Sprintf("%s: %s", name, value))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (headers headerFlag) Set(value string) error {
+	name, headervalue, ok := strings.Cut(value, ":")
+	if !ok || len(strings.TrimSpace(name)) == 0 {
+		return errors.New("header must look like \"Name: value\"")
+	}
+
+	headers[strings.TrimSpace(name)] = strings.TrimSpace(headervalue)
+	return nil
+}
+
+type httpFlags struct {
+	config         *string
+	headers        headerFlag
+	userAgent      *string
+	cookieFile     *string
+	proxy          *string
+	caBundle       *string
+	timeout        *string
+	connectTimeout *string
+}
+
+func addHTTPFlags(flags *flag.FlagSet) *httpFlags {
+	httpflags := &httpFlags{headers: make(headerFlag)}
+
+	httpflags.config = flags.String("http-config", "", "json file with headers, user_agent, cookie_file, proxy, ca_bundle, timeout and connect_timeout")
+	flags.Var(httpflags.headers, "header", "extra request header as \"Name: value\" (repeatable)")
+	httpflags.userAgent = flags.String("user-agent", "", "user agent sent with every request")
+	httpflags.cookieFile = flags.String("cookies", "", "netscape cookies.txt to load into the cookie jar")
+	httpflags.proxy = flags.String("proxy", "", "http(s):// or socks5:// proxy, defaults to HTTP_PROXY/HTTPS_PROXY")
+	httpflags.caBundle = flags.String("ca-bundle", "", "pem file with extra root certificates")
+	httpflags.timeout = flags.String("timeout", "", "overall timeout per request, e.g. 30s")
+	httpflags.connectTimeout = flags.String("connect-timeout", "", "timeout for establishing connections, e.g. 10s")
+
+	return httpflags
+}
+
+// apply builds the http fetcher from the config file with the flags layered on top and registers it.
+func (httpflags *httpFlags) apply() error {
+	var config HTTPConfig
+
+	if len(*httpflags.config) > 0 {
+		loaded, err := LoadHTTPConfig(*httpflags.config)
+		if err != nil {
+			return err
+		}
+		config = loaded
+	}
+
+	if len(httpflags.headers) > 0 && config.Headers == nil {
+		config.Headers = make(map[string]string)
+	}
+	for name, value := range httpflags.headers {
+		config.Headers[name] = value
+	}
+
+	overrides := []struct {
+		flag   *string
+		target *string
+	}{
+		{httpflags.userAgent, &config.UserAgent},
+		{httpflags.cookieFile, &config.CookieFile},
+		{httpflags.proxy, &config.Proxy},
+		{httpflags.caBundle, &config.CABundle},
+		{httpflags.timeout, &config.Timeout},
+		{httpflags.connectTimeout, &config.ConnectTimeout},
+	}
+
+	for _, override := range overrides {
+		if len(*override.flag) > 0 {
+			*override.target = *override.flag
+		}
+	}
+
+	fetcher, err := NewHTTPFetcher(config)
+	if err != nil {
+		return err
+	}
+
+	RegisterFetcher("http", fetcher)
+	RegisterFetcher("https", fetcher)
+
+	return nil
+}
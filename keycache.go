@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type KeyCacheEntry struct {
+	KID   string    `json:"kid,omitempty"`
+	Nonce string    `json:"nonce,omitempty"`
+	Key   string    `json:"key"`
+	Added time.Time `json:"added"`
+}
+
+// KeyCache remembers unwrapped content keys by default_KID and envelope nonce so a run can skip the
+// key store, or find the key of a manifest without its blurl. A nil KeyCache never hits.
+type KeyCache struct {
+	path    string
+	mu      sync.Mutex
+	entries []KeyCacheEntry
+}
+
+// normalizeKID makes "0123ABCD-..." and "0123abcd..." the same kid.
+func normalizeKID(kid string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(kid), "-", ""))
+}
+
+func defaultKeyCachePath() string {
+	cachedir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cachedir, "blurlconvert", "keycache.json")
+}
+
+// LoadKeyCache reads the cache at path, a missing file is an empty cache.
+func LoadKeyCache(path string) (*KeyCache, error) {
+	cache := &KeyCache{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &cache.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func (cache *KeyCache) find(match func(entry *KeyCacheEntry) bool) []byte {
+	if cache == nil {
+		return nil
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for idx := range cache.entries {
+		if !match(&cache.entries[idx]) {
+			continue
+		}
+
+		key, err := hex.DecodeString(cache.entries[idx].Key)
+		if err == nil {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func (cache *KeyCache) ByNonce(nonce string) []byte {
+	if len(nonce) == 0 {
+		return nil
+	}
+
+	return cache.find(func(entry *KeyCacheEntry) bool {
+		return entry.Nonce == nonce
+	})
+}
+
+func (cache *KeyCache) ByKID(kid string) []byte {
+	kid = normalizeKID(kid)
+	if len(kid) == 0 {
+		return nil
+	}
+
+	return cache.find(func(entry *KeyCacheEntry) bool {
+		return entry.KID == kid
+	})
+}
+
+// Put records key under kid and nonce, filling in whichever one an existing entry for the same key
+// is missing, and saves the cache.
+func (cache *KeyCache) Put(kid string, nonce string, key []byte) error {
+	if cache == nil || len(key) == 0 {
+		return nil
+	}
+
+	kid = normalizeKID(kid)
+	if len(kid) == 0 && len(nonce) == 0 {
+		return nil
+	}
+
+	hexkey := hex.EncodeToString(key)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	updated := false
+	for idx := range cache.entries {
+		entry := &cache.entries[idx]
+		if entry.Key != hexkey {
+			continue
+		}
+		if (len(kid) > 0 && entry.KID == kid) || (len(nonce) > 0 && entry.Nonce == nonce) {
+			entry.KID = firstNonEmpty(entry.KID, kid)
+			entry.Nonce = firstNonEmpty(entry.Nonce, nonce)
+			updated = true
+			break
+		}
+	}
+
+	if !updated {
+		cache.entries = append(cache.entries, KeyCacheEntry{KID: kid, Nonce: nonce, Key: hexkey, Added: time.Now().UTC()})
+	}
+
+	return cache.save()
+}
+
+func (cache *KeyCache) save() error {
+	data, err := json.MarshalIndent(cache.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(cache.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpfile, err := os.CreateTemp(filepath.Dir(cache.path), ".keycache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write(append(data, '\n'))
+	if err != nil {
+		tmpfile.Close()
+		return err
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), cache.path)
+}
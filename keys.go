@@ -0,0 +1,473 @@
+package main
+
+import (
+	"blurlconvert/blurldecrypt"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const keyStoreName = "keys.bin"
+
+type pathListFlag []string
+
+func (paths *pathListFlag) String() string {
+	return strings.Join(*paths, string(os.PathListSeparator))
+}
+
+func (paths *pathListFlag) Set(value string) error {
+	*paths = append(*paths, filepath.SplitList(value)...)
+	return nil
+}
+
+// keyStoreCandidates lists where key stores are looked for, the tests replace it to keep the
+// developer's own key stores out of the search.
+var keyStoreCandidates = defaultKeyStoreCandidates
+
+// defaultKeyStoreCandidates searches, in order: every -keys path, every path in BLURLCONVERT_KEYS,
+// keys.bin next to the executable, in the user config dir and finally in the current directory.
+func defaultKeyStoreCandidates(flagpaths []string) []string {
+	var candidates []string
+
+	candidates = append(candidates, flagpaths...)
+
+	if env := os.Getenv("BLURLCONVERT_KEYS"); len(env) > 0 {
+		candidates = append(candidates, filepath.SplitList(env)...)
+	}
+
+	if executable, err := os.Executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+			executable = resolved
+		}
+		candidates = append(candidates, filepath.Join(filepath.Dir(executable), keyStoreName))
+	}
+
+	// honours XDG_CONFIG_HOME on linux
+	if configdir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(configdir, "blurlconvert", keyStoreName))
+	}
+
+	candidates = append(candidates, keyStoreName)
+
+	return candidates
+}
+
+// findKeyStores returns the candidates that exist, without duplicates and in search order.
+func findKeyStores(flagpaths []string) []string {
+	var stores []string
+	seen := make(map[string]bool)
+
+	for _, candidate := range keyStoreCandidates(flagpaths) {
+		if len(candidate) == 0 {
+			continue
+		}
+
+		absolute, err := filepath.Abs(candidate)
+		if err != nil {
+			absolute = candidate
+		}
+		if seen[absolute] {
+			continue
+		}
+		seen[absolute] = true
+
+		info, err := os.Stat(candidate)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		stores = append(stores, candidate)
+	}
+
+	return stores
+}
+
+type keyRecordJSON struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Check    string `json:"check"`
+	Reserved string `json:"reserved"`
+	Key      string `json:"key"`
+}
+
+type keyStoreJSON struct {
+	Records  []keyRecordJSON `json:"records"`
+	Trailing string          `json:"trailing,omitempty"`
+}
+
+func decodeHexField(name string, value string, size int) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("%s must be %d bytes, got %d", name, size, len(b))
+	}
+	return b, nil
+}
+
+func (record keyRecordJSON) KeyRecord() (blurldecrypt.KeyRecord, error) {
+	var keyrecord blurldecrypt.KeyRecord
+
+	id, err := decodeHexField("id", record.ID, 4)
+	if err != nil {
+		return keyrecord, err
+	}
+	check, err := decodeHexField("check", record.Check, 1)
+	if err != nil {
+		return keyrecord, err
+	}
+	key, err := decodeHexField("key", record.Key, 32)
+	if err != nil {
+		return keyrecord, err
+	}
+
+	copy(keyrecord.ID[:], id)
+	keyrecord.Check = check[0]
+	copy(keyrecord.Key[:], key)
+
+	if len(record.Reserved) > 0 {
+		reserved, err := decodeHexField("reserved", record.Reserved, 15)
+		if err != nil {
+			return keyrecord, err
+		}
+		copy(keyrecord.Reserved[:], reserved)
+	}
+
+	return keyrecord, nil
+}
+
+func exportKeyStore(store *blurldecrypt.KeyStore, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		export := keyStoreJSON{Records: []keyRecordJSON{}, Trailing: hex.EncodeToString(store.Trailing())}
+		for idx, record := range store.Records() {
+			export.Records = append(export.Records, keyRecordJSON{
+				Index:    idx,
+				ID:       hex.EncodeToString(record.ID[:]),
+				Check:    hex.EncodeToString([]byte{record.Check}),
+				Reserved: hex.EncodeToString(record.Reserved[:]),
+				Key:      hex.EncodeToString(record.Key[:]),
+			})
+		}
+
+		data, err := json.MarshalIndent(export, "", "  ")
+		return append(data, '\n'), err
+	case "hex":
+		// one record per line, the trailing partial record (if any) on the last line
+		var contents strings.Builder
+		for _, record := range store.Records() {
+			contents.WriteString(hex.EncodeToString(record.Bytes()) + "\n")
+		}
+		if trailing := store.Trailing(); len(trailing) > 0 {
+			contents.WriteString(hex.EncodeToString(trailing) + "\n")
+		}
+		return []byte(contents.String()), nil
+	}
+
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// importKeyStore reads the json or hex form written by exportKeyStore.
+func importKeyStore(data []byte) (*blurldecrypt.KeyStore, error) {
+	trimmed := bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var export keyStoreJSON
+		err := json.Unmarshal(trimmed, &export)
+		if err != nil {
+			return nil, err
+		}
+
+		store := blurldecrypt.NewKeyStore()
+		for idx, jsonrecord := range export.Records {
+			record, err := jsonrecord.KeyRecord()
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %v", idx, err)
+			}
+
+			store.Add(record)
+		}
+
+		trailing, err := hex.DecodeString(export.Trailing)
+		if err != nil {
+			return nil, fmt.Errorf("trailing: %v", err)
+		}
+
+		return blurldecrypt.ParseKeyStore(append(store.Bytes(), trailing...))
+	}
+
+	binary, err := hex.DecodeString(strings.Join(strings.Fields(string(trimmed)), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	return blurldecrypt.ParseKeyStore(binary)
+}
+
+// writeKeyStore replaces filePath without ever leaving a half written key store behind.
+func writeKeyStore(filePath string, store *blurldecrypt.KeyStore) error {
+	tmpfile, err := os.CreateTemp(filepath.Dir(filePath), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	// keep the permissions of the store being replaced
+	if info, err := os.Stat(filePath); err == nil {
+		tmpfile.Chmod(info.Mode().Perm())
+	}
+
+	_, err = tmpfile.Write(store.Bytes())
+	if err != nil {
+		tmpfile.Close()
+		return err
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), filePath)
+}
+
+// verifyKeyStore lists everything wrong with the raw contents of a key store.
+func verifyKeyStore(data []byte) []string {
+	if len(data) == 0 {
+		return []string{"file is empty"}
+	}
+
+	if len(data)%blurldecrypt.KeyRecordSize != 0 {
+		return []string{fmt.Sprintf("length %d is not a multiple of 0x%x, %d trailing bytes after %d records", len(data), blurldecrypt.KeyRecordSize, len(data)%blurldecrypt.KeyRecordSize, len(data)/blurldecrypt.KeyRecordSize)}
+	}
+
+	return nil
+}
+
+const keysUsage = `usage: blurlconvert keys [-file keys.bin] <command>
+
+commands:
+  list                                     print index, id and check byte of every record
+  add -id <hex> -key <hex> (-check <hex> | -nonce <nonce>) [-reserved <hex>]
+  remove <index>
+  verify                                   check that the length is a multiple of the record size
+  export [-format json|hex] [-o file]      print the records in a readable form
+  import <file>                            replace the key store with an exported json or hex file`
+
+// RunKeys manages the records of a key store.
+func RunKeys(args []string) {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	file := flags.String("file", "", "key store to work on, defaults to the first one found in the usual locations")
+	flags.Usage = func() { fmt.Println(keysUsage) }
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	filePath := *file
+	if len(filePath) == 0 {
+		filePath = keyStoreName
+		if stores := findKeyStores(nil); len(stores) > 0 {
+			filePath = stores[0]
+		}
+	}
+
+	command := flags.Arg(0)
+	commandargs := flags.Args()[1:]
+
+	var err error
+	switch command {
+	case "list":
+		err = keysList(filePath)
+	case "add":
+		err = keysAdd(filePath, commandargs)
+	case "remove":
+		err = keysRemove(filePath, commandargs)
+	case "verify":
+		err = keysVerify(filePath)
+	case "export":
+		err = keysExport(filePath, commandargs)
+	case "import":
+		err = keysImport(filePath, commandargs)
+	default:
+		fmt.Printf("unknown keys command %q\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func keysList(filePath string) error {
+	store, err := blurldecrypt.LoadKeyStore(filePath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d records\n", filePath, store.Len())
+	for idx, record := range store.Records() {
+		fmt.Printf("%3d  %x  %02x\n", idx, record.ID, record.Check)
+	}
+
+	return nil
+}
+
+func keysAdd(filePath string, args []string) error {
+	flags := flag.NewFlagSet("keys add", flag.ExitOnError)
+	id := flags.String("id", "", "4 byte record id as hex")
+	key := flags.String("key", "", "32 byte key as hex")
+	check := flags.String("check", "", "check byte as hex")
+	nonce := flags.String("nonce", "", "envelope nonce to derive the check byte from")
+	reserved := flags.String("reserved", "", "15 reserved bytes as hex, zero when left out")
+	flags.Parse(args)
+
+	if len(*check) == 0 && len(*nonce) == 0 {
+		return errors.New("keys add needs -check or -nonce")
+	}
+
+	jsonrecord := keyRecordJSON{ID: *id, Check: *check, Reserved: *reserved, Key: *key}
+	if len(*check) == 0 {
+		// a placeholder so the record parses, the real check byte is md5(id+nonce)[0] and is derived from -nonce below
+		jsonrecord.Check = "00"
+	}
+
+	record, err := jsonrecord.KeyRecord()
+	if err != nil {
+		return err
+	}
+
+	if len(*nonce) > 0 {
+		derived := blurldecrypt.CheckByte(record.ID, *nonce)
+		if len(*check) > 0 && derived != record.Check {
+			return fmt.Errorf("check byte %02x does not match %02x derived from nonce %q", record.Check, derived, *nonce)
+		}
+		record.Check = derived
+	}
+
+	store, err := blurldecrypt.LoadKeyStore(filePath)
+	if errors.Is(err, blurldecrypt.ErrKeyStoreNotFound) {
+		store, err = blurldecrypt.NewKeyStore(), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	store.Add(record)
+
+	err = writeKeyStore(filePath, store)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added record %d (%x) to %s\n", store.Len()-1, record.ID, filePath)
+	return nil
+}
+
+func keysRemove(filePath string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: blurlconvert keys remove <index>")
+	}
+
+	idx, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid index %q", args[0])
+	}
+
+	store, err := blurldecrypt.LoadKeyStore(filePath)
+	if err != nil {
+		return err
+	}
+
+	record, err := store.Remove(idx)
+	if err != nil {
+		return err
+	}
+
+	err = writeKeyStore(filePath, store)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed record %d (%x) from %s\n", idx, record.ID, filePath)
+	return nil
+}
+
+func keysVerify(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	problems := verifyKeyStore(data)
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok, %d records\n", filePath, len(data)/blurldecrypt.KeyRecordSize)
+		return nil
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", filePath, problem)
+	}
+
+	return fmt.Errorf("%s: %w", filePath, blurldecrypt.ErrKeyStoreCorrupt)
+}
+
+func keysExport(filePath string, args []string) error {
+	flags := flag.NewFlagSet("keys export", flag.ExitOnError)
+	format := flags.String("format", "json", "json or hex")
+	out := flags.String("o", "", "write to this file instead of stdout")
+	flags.Parse(args)
+
+	store, err := blurldecrypt.LoadKeyStore(filePath)
+	if err != nil {
+		return err
+	}
+
+	data, err := exportKeyStore(store, *format)
+	if err != nil {
+		return err
+	}
+
+	if len(*out) == 0 || *out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(*out, data, 0600)
+}
+
+func keysImport(filePath string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: blurlconvert keys import <file>")
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	store, err := importKeyStore(data)
+	if err != nil {
+		return fmt.Errorf("Error importing %s: %v", args[0], err)
+	}
+
+	err = writeKeyStore(filePath, store)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d records into %s\n", store.Len(), filePath)
+	return nil
+}
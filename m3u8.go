@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HLSByteRange struct {
+	Length int64
+	Offset int64
+}
+
+type HLSKey struct {
+	Method    string
+	URI       string
+	IV        string
+	KeyFormat string
+}
+
+type HLSMap struct {
+	URI       string
+	ByteRange *HLSByteRange
+}
+
+type HLSSegment struct {
+	URI       string
+	Duration  float64
+	Sequence  int64
+	ByteRange *HLSByteRange
+	Key       *HLSKey
+	Map       *HLSMap
+}
+
+type HLSVariant struct {
+	URI       string
+	Bandwidth int64
+	Codecs    string
+	Audio     string
+}
+
+type HLSRendition struct {
+	Type     string
+	GroupID  string
+	Name     string
+	Language string
+	URI      string
+	Default  bool
+}
+
+type HLSPlaylist struct {
+	Version        int
+	TargetDuration float64
+	MediaSequence  int64
+	Segments       []HLSSegment
+	Variants       []HLSVariant
+	Renditions     []HLSRendition
+}
+
+func IsHLSManifest(playlist *Playlist, contenttype string, manifest []byte) bool {
+	if strings.Contains(strings.ToLower(playlist.Type), "hls") {
+		return true
+	}
+
+	if strings.Contains(strings.ToLower(contenttype), "mpegurl") {
+		return true
+	}
+
+	if u, err := url.Parse(playlist.URL); err == nil && strings.HasSuffix(u.Path, ".m3u8") {
+		return true
+	}
+
+	return bytes.HasPrefix(bytes.TrimSpace(manifest), []byte("#EXTM3U"))
+}
+
+func parseHLSAttributes(line string) map[string]string {
+	attributes := make(map[string]string)
+
+	for len(line) > 0 {
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			break
+		}
+
+		name := strings.TrimSpace(line[:eq])
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := strings.IndexByte(line[1:], '"')
+			if end == -1 {
+				value = line[1:]
+				line = ""
+			} else {
+				value = line[1 : end+1]
+				line = line[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(line, ',')
+			if end == -1 {
+				value = line
+				line = ""
+			} else {
+				value = line[:end]
+				line = line[end:]
+			}
+		}
+
+		attributes[name] = value
+		line = strings.TrimPrefix(line, ",")
+	}
+
+	return attributes
+}
+
+func parseHLSByteRange(value string) (*HLSByteRange, bool, error) {
+	lengthstr, offsetstr, hasoffset := strings.Cut(value, "@")
+
+	length, err := strconv.ParseInt(lengthstr, 10, 64)
+	if err != nil || length <= 0 {
+		return nil, false, fmt.Errorf("invalid byte range %q", value)
+	}
+
+	byterange := &HLSByteRange{Length: length}
+
+	if hasoffset {
+		byterange.Offset, err = strconv.ParseInt(offsetstr, 10, 64)
+		if err != nil || byterange.Offset < 0 || byterange.Offset > math.MaxInt64-length {
+			return nil, false, fmt.Errorf("invalid byte range %q", value)
+		}
+	}
+
+	return byterange, hasoffset, nil
+}
+
+func ParseHLSPlaylist(data []byte) (*HLSPlaylist, error) {
+	var playlist HLSPlaylist
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, errors.New("playlist is missing the #EXTM3U header")
+	}
+
+	var currentkey *HLSKey
+	var currentmap *HLSMap
+	var pending HLSSegment
+	var pendingvariant *HLSVariant
+	var lastrangeuri string
+	var lastrangeend int64
+	sequence := int64(-1)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			if pendingvariant != nil {
+				pendingvariant.URI = line
+				playlist.Variants = append(playlist.Variants, *pendingvariant)
+				pendingvariant = nil
+				continue
+			}
+
+			if sequence == -1 {
+				sequence = playlist.MediaSequence
+			}
+
+			pending.URI = line
+			pending.Sequence = sequence
+			pending.Key = currentkey
+			pending.Map = currentmap
+
+			if pending.ByteRange != nil {
+				// a byte range without an offset continues right after the previous range of the same resource
+				if pending.ByteRange.Offset == -1 {
+					if lastrangeuri != line {
+						return nil, fmt.Errorf("byte range for %s has no offset and no previous range to continue from", line)
+					}
+					pending.ByteRange.Offset = lastrangeend
+				}
+				if pending.ByteRange.Offset > math.MaxInt64-pending.ByteRange.Length {
+					return nil, fmt.Errorf("byte range for %s is out of bounds", line)
+				}
+				lastrangeuri = line
+				lastrangeend = pending.ByteRange.Offset + pending.ByteRange.Length
+			}
+
+			playlist.Segments = append(playlist.Segments, pending)
+			pending = HLSSegment{}
+			sequence++
+			continue
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+
+		switch tag {
+		case "#EXT-X-VERSION":
+			playlist.Version, _ = strconv.Atoi(value)
+		case "#EXT-X-TARGETDURATION":
+			playlist.TargetDuration, _ = strconv.ParseFloat(value, 64)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			mediasequence, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid media sequence %q", value)
+			}
+			playlist.MediaSequence = mediasequence
+		case "#EXTINF":
+			durationstr, _, _ := strings.Cut(value, ",")
+			duration, err := strconv.ParseFloat(durationstr, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid segment duration %q", value)
+			}
+			pending.Duration = duration
+		case "#EXT-X-BYTERANGE":
+			byterange, hasoffset, err := parseHLSByteRange(value)
+			if err != nil {
+				return nil, err
+			}
+			if !hasoffset {
+				byterange.Offset = -1
+			}
+			pending.ByteRange = byterange
+		case "#EXT-X-KEY":
+			attributes := parseHLSAttributes(value)
+			if attributes["METHOD"] == "NONE" {
+				currentkey = nil
+				continue
+			}
+			currentkey = &HLSKey{
+				Method:    attributes["METHOD"],
+				URI:       attributes["URI"],
+				IV:        attributes["IV"],
+				KeyFormat: attributes["KEYFORMAT"],
+			}
+		case "#EXT-X-MAP":
+			attributes := parseHLSAttributes(value)
+			currentmap = &HLSMap{URI: attributes["URI"]}
+			if len(attributes["BYTERANGE"]) > 0 {
+				byterange, hasoffset, err := parseHLSByteRange(attributes["BYTERANGE"])
+				if err != nil {
+					return nil, err
+				}
+				if !hasoffset {
+					return nil, errors.New("EXT-X-MAP byte range must have an offset")
+				}
+				currentmap.ByteRange = byterange
+			}
+		case "#EXT-X-STREAM-INF":
+			attributes := parseHLSAttributes(value)
+			bandwidth, _ := strconv.ParseInt(attributes["BANDWIDTH"], 10, 64)
+			pendingvariant = &HLSVariant{
+				Bandwidth: bandwidth,
+				Codecs:    attributes["CODECS"],
+				Audio:     attributes["AUDIO"],
+			}
+		case "#EXT-X-MEDIA":
+			attributes := parseHLSAttributes(value)
+			playlist.Renditions = append(playlist.Renditions, HLSRendition{
+				Type:     attributes["TYPE"],
+				GroupID:  attributes["GROUP-ID"],
+				Name:     attributes["NAME"],
+				Language: attributes["LANGUAGE"],
+				URI:      attributes["URI"],
+				Default:  attributes["DEFAULT"] == "YES",
+			})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &playlist, nil
+}
+
+func resolveURL(baseurl string, uri string) (string, error) {
+	base, err := url.Parse(baseurl)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+func fetchHLSResource(resourceurl string, byterange *HLSByteRange) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, resourceurl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if byterange != nil {
+		if byterange.Length <= 0 || byterange.Offset < 0 || byterange.Offset > math.MaxInt64-byterange.Length {
+			return nil, fmt.Errorf("invalid byte range %d@%d for %s", byterange.Length, byterange.Offset, resourceurl)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", byterange.Offset, byterange.Offset+byterange.Length-1))
+	}
+
+	resp, err := doFetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("bad status while downloading %s: %s", resourceurl, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+		return nil, fmt.Errorf("%s is truncated: got %d of %d bytes", resourceurl, len(body), resp.ContentLength)
+	}
+
+	// servers that ignore the range header send the whole resource back
+	if byterange != nil && resp.StatusCode == http.StatusOK {
+		if byterange.Offset > int64(len(body)) || byterange.Length > int64(len(body))-byterange.Offset {
+			return nil, fmt.Errorf("byte range %d@%d is outside of %s", byterange.Length, byterange.Offset, resourceurl)
+		}
+		body = body[byterange.Offset : byterange.Offset+byterange.Length]
+	}
+
+	return body, nil
+}
+
+func decryptHLSSegment(data []byte, key []byte, ivstr string, sequence int64) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+
+	if len(ivstr) > 0 {
+		decodediv, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(ivstr, "0x"), "0X"))
+		if err != nil || len(decodediv) != aes.BlockSize {
+			return nil, fmt.Errorf("invalid iv %q", ivstr)
+		}
+		copy(iv, decodediv)
+	} else {
+		// without an explicit iv the media sequence number is used as a big endian 128 bit integer
+		binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("segment is not a multiple of the block size")
+	}
+
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid segment padding")
+	}
+
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+func sameHLSMap(a *HLSMap, b *HLSMap) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if a.URI != b.URI {
+		return false
+	}
+
+	if a.ByteRange == nil || b.ByteRange == nil {
+		return a.ByteRange == b.ByteRange
+	}
+
+	return *a.ByteRange == *b.ByteRange
+}
+
+func hlsContentType(codecs string, fallback string) string {
+	if len(codecs) == 0 {
+		return fallback
+	}
+
+	for _, codec := range strings.Split(codecs, ",") {
+		codec = strings.TrimSpace(codec)
+		if !strings.HasPrefix(codec, "mp4a") && !strings.HasPrefix(codec, "ac-3") && !strings.HasPrefix(codec, "ec-3") && !strings.HasPrefix(codec, "opus") && !strings.HasPrefix(codec, "flac") {
+			return "video"
+		}
+	}
+
+	return "audio"
+}
+
+func HandleDownloadHLSTrack(workdir string, id string, playlisturl string, playlist *HLSPlaylist, key []byte, checksums *ChecksumManifest) (string, error) {
+	if len(playlist.Segments) == 0 {
+		return "", errors.New("hls playlist has no segments")
+	}
+
+	fmt.Println(playlisturl)
+
+	downloads := filepath.Join(workdir, "downloads")
+
+	err := os.MkdirAll(downloads, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	initmap := playlist.Segments[0].Map
+	samplebased := false
+
+	for _, segment := range playlist.Segments {
+		if !sameHLSMap(segment.Map, initmap) {
+			return "", errors.New("playlists that switch EXT-X-MAP mid stream are not supported")
+		}
+		if segment.Key != nil && strings.HasPrefix(segment.Key.Method, "SAMPLE-AES") {
+			samplebased = true
+		}
+	}
+
+	extension := "ts"
+	if initmap != nil {
+		extension = "mp4"
+	}
+
+	if samplebased && initmap == nil {
+		return "", errors.New("SAMPLE-AES is only supported for fragmented mp4 playlists")
+	}
+
+	trackname := fmt.Sprintf("%s.%s", id, extension)
+
+	mastertrack, err := os.Create(filepath.Join(downloads, trackname))
+	if err != nil {
+		return "", err
+	}
+	defer mastertrack.Close()
+
+	if initmap != nil {
+		mapurl, err := resolveURL(playlisturl, initmap.URI)
+		if err != nil {
+			return "", err
+		}
+
+		initdata, err := fetchHLSResource(mapurl, initmap.ByteRange)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = mastertrack.Write(initdata)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var wg sync.WaitGroup
+	var errmu sync.Mutex
+	var downloaderr error
+
+	progress.StartTrack(id, len(playlist.Segments))
+
+	for idx, segment := range playlist.Segments {
+		wg.Add(1)
+
+		go func(index int, segment HLSSegment) {
+			defer wg.Done()
+
+			segmenturl, err := resolveURL(playlisturl, segment.URI)
+			if err == nil {
+				var data []byte
+				data, err = fetchHLSResource(segmenturl, segment.ByteRange)
+				if err == nil {
+					progress.AddBytes(id, int64(len(data)))
+					err = os.WriteFile(filepath.Join(downloads, fmt.Sprintf("%s_%d.seg", id, index)), data, 0644)
+				}
+				if err == nil {
+					progress.SegmentDone(id)
+				}
+			}
+
+			if err != nil {
+				errmu.Lock()
+				if downloaderr == nil {
+					downloaderr = err
+				}
+				errmu.Unlock()
+			}
+		}(idx, segment)
+	}
+
+	wg.Wait()
+
+	progress.FinishTrack(id)
+
+	if downloaderr != nil {
+		return "", downloaderr
+	}
+
+	keys := make(map[string][]byte)
+	var sequencechecker SequenceChecker
+
+	for idx, segment := range playlist.Segments {
+		segmentname := filepath.Join(downloads, fmt.Sprintf("%s_%d.seg", id, idx))
+
+		data, err := os.ReadFile(segmentname)
+		if err != nil {
+			return "", err
+		}
+
+		if segment.Key != nil && segment.Key.Method == "AES-128" {
+			segmentkey := key
+
+			// without a key from the blurl envelope fall back to the key uri in the playlist
+			if len(segmentkey) == 0 {
+				if _, ok := keys[segment.Key.URI]; !ok {
+					keyurl, err := resolveURL(playlisturl, segment.Key.URI)
+					if err != nil {
+						return "", err
+					}
+
+					keys[segment.Key.URI], err = fetchHLSResource(keyurl, nil)
+					if err != nil {
+						return "", fmt.Errorf("failed to fetch segment key: %v", err)
+					}
+				}
+				segmentkey = keys[segment.Key.URI]
+			}
+
+			data, err = decryptHLSSegment(data, segmentkey, segment.Key.IV, segment.Sequence)
+			if err != nil {
+				return "", fmt.Errorf("failed to decrypt segment %d: %v", idx, err)
+			}
+		} else if segment.Key != nil && !strings.HasPrefix(segment.Key.Method, "SAMPLE-AES") {
+			return "", fmt.Errorf("unsupported encryption method %s", segment.Key.Method)
+		}
+
+		// transport stream segments have no box structure to check
+		if initmap != nil {
+			sequences, err := ValidateSegment(data)
+			if err != nil {
+				return "", fmt.Errorf("segment %d failed validation: %v", idx, err)
+			}
+
+			err = sequencechecker.Check(segment.URI, sequences)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		checksums.Add(fmt.Sprintf("%s/%s", id, path.Base(segment.URI)), data)
+
+		_, err = mastertrack.Write(data)
+		if err != nil {
+			return "", err
+		}
+
+		err = os.Remove(segmentname)
+		if err != nil {
+			fmt.Println("Error deleting segment:", err)
+		}
+	}
+
+	if samplebased {
+		if len(key) == 0 {
+			return "", errors.New("playlist uses SAMPLE-AES but no content key was found")
+		}
+
+		err = DecryptPlaylist(workdir, id, trackname, hex.EncodeToString(key))
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(workdir, fmt.Sprintf("%s.mp4", id)), nil
+	}
+
+	initfile, err := os.Open(filepath.Join(downloads, trackname))
+	if err != nil {
+		return "", err
+	}
+	defer initfile.Close()
+
+	final_master, err := os.Create(filepath.Join(workdir, fmt.Sprintf("%s.%s", id, extension)))
+	if err != nil {
+		return "", err
+	}
+	defer final_master.Close()
+
+	_, err = io.Copy(final_master, initfile)
+	if err != nil {
+		return "", err
+	}
+
+	return final_master.Name(), nil
+}
+
+func ProcessHLSPlaylist(workdir string, playlisturl string, manifest []byte, key []byte, audioonly bool, writechecksums bool, result *RunResult) error {
+	playlist, err := ParseHLSPlaylist(manifest)
+	if err != nil {
+		return err
+	}
+
+	var checksummanifest *ChecksumManifest
+	if writechecksums {
+		checksummanifest = &ChecksumManifest{}
+	}
+
+	defaulttype := "video"
+	if audioonly {
+		defaulttype = "audio"
+	}
+
+	type hlstrack struct {
+		mediatype string
+		groupid   string
+		uri       string
+		codecs    string
+		bandwidth int64
+		language  string
+	}
+
+	var tracks []hlstrack
+
+	if len(playlist.Variants) == 0 {
+		tracks = append(tracks, hlstrack{mediatype: defaulttype})
+	} else {
+		// pick the best variant and whichever audio rendition it points at
+		variant := playlist.Variants[0]
+		for _, candidate := range playlist.Variants[1:] {
+			if candidate.Bandwidth > variant.Bandwidth {
+				variant = candidate
+			}
+		}
+
+		tracks = append(tracks, hlstrack{mediatype: hlsContentType(variant.Codecs, defaulttype), uri: variant.URI, codecs: variant.Codecs, bandwidth: variant.Bandwidth})
+
+		if len(variant.Audio) > 0 {
+			var rendition *HLSRendition
+			for idx := range playlist.Renditions {
+				candidate := &playlist.Renditions[idx]
+				if candidate.Type != "AUDIO" || candidate.GroupID != variant.Audio || len(candidate.URI) == 0 {
+					continue
+				}
+				if rendition == nil || candidate.Default {
+					rendition = candidate
+				}
+			}
+
+			if rendition != nil {
+				tracks = append(tracks, hlstrack{mediatype: "audio", groupid: rendition.GroupID, uri: rendition.URI, language: rendition.Language})
+			}
+		}
+	}
+
+	// a variant and a rendition can share a media type, so outputs follow the order of tracks
+	outputs := make([]string, len(tracks))
+	downloadstart := time.Now()
+
+	for idx, track := range tracks {
+		mediaurl := playlisturl
+		mediaplaylist := playlist
+
+		// a media playlist given directly is already parsed, variants and renditions still need fetching
+		if len(track.uri) > 0 {
+			mediaurl, err = resolveURL(playlisturl, track.uri)
+			if err != nil {
+				return err
+			}
+
+			mediamanifest, _, err := fetchManifest(mediaurl)
+			if err != nil {
+				return err
+			}
+
+			mediaplaylist, err = ParseHLSPlaylist(mediamanifest)
+			if err != nil {
+				return err
+			}
+		}
+
+		trackstart := time.Now()
+
+		output, err := HandleDownloadHLSTrack(workdir, trackID(track.mediatype, track.groupid, idx), mediaurl, mediaplaylist, key, checksummanifest)
+		if err != nil {
+			return err
+		}
+
+		outputs[idx] = output
+
+		var duration float64
+		for _, segment := range mediaplaylist.Segments {
+			duration += segment.Duration
+		}
+
+		if duration > result.Duration {
+			result.Duration = duration
+		}
+		result.SegmentCount += len(mediaplaylist.Segments)
+
+		result.Tracks = append(result.Tracks, TrackResult{
+			ContentType:     track.mediatype,
+			Language:        track.language,
+			Codecs:          track.codecs,
+			Bandwidth:       track.bandwidth,
+			Segments:        len(mediaplaylist.Segments),
+			Output:          output,
+			DownloadSeconds: secondsSince(trackstart),
+		})
+	}
+
+	result.Timings.DownloadSeconds = secondsSince(downloadstart)
+
+	inputbasename := strings.TrimSuffix(filepath.Base(result.Input), filepath.Ext(result.Input))
+
+	var pending []pendingOutput
+	videoidx, audioidx := -1, -1
+	for idx, track := range tracks {
+		if track.mediatype == "video" && videoidx == -1 {
+			videoidx = idx
+		}
+		if track.mediatype == "audio" && audioidx == -1 {
+			audioidx = idx
+		}
+
+		pending = append(pending, pendingOutput{Path: outputs[idx], Fields: NameFields{
+			Language:      firstNonEmpty(track.language, result.Playlist.Language),
+			Type:          track.mediatype,
+			Codec:         track.codecs,
+			InputBasename: inputbasename,
+		}})
+	}
+
+	merged := ""
+
+	if videoidx != -1 && audioidx != -1 {
+		mergestart := time.Now()
+
+		merged = Merge(workdir, outputs[videoidx], outputs[audioidx], kid62(playlisturl))
+		if len(merged) > 0 {
+			pending = []pendingOutput{{Path: merged, Fields: NameFields{
+				Language:      firstNonEmpty(tracks[audioidx].language, result.Playlist.Language),
+				Type:          "muxed",
+				Codec:         tracks[videoidx].codecs,
+				InputBasename: inputbasename,
+			}}}
+		}
+
+		result.Timings.MergeSeconds = secondsSince(mergestart)
+	}
+
+	return finishOutputs(pending, merged, checksummanifest, result)
+}
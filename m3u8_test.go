@@ -0,0 +1,184 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHLSMediaPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="100@0"
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:2.000,
+#EXT-X-BYTERANGE:500@100
+media.mp4
+#EXTINF:1.500,
+#EXT-X-BYTERANGE:400
+media.mp4
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:2,
+segment_2.m4s
+#EXT-X-ENDLIST
+`
+
+const testHLSMasterPlaylist = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="Deutsch",LANGUAGE="de",URI="audio/de.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.64001f,mp4a.40.2",AUDIO="aac"
+low/video.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2400000,CODECS="avc1.640028,mp4a.40.2",AUDIO="aac"
+high/video.m3u8
+`
+
+func TestParseHLSPlaylist(t *testing.T) {
+	key := &HLSKey{Method: "AES-128", URI: "key.bin", IV: "0x000102030405060708090a0b0c0d0e0f"}
+	initmap := &HLSMap{URI: "init.mp4", ByteRange: &HLSByteRange{Length: 100, Offset: 0}}
+
+	tests := []struct {
+		name     string
+		manifest string
+		want     *HLSPlaylist
+		err      string
+	}{
+		{
+			name:     "media playlist",
+			manifest: testHLSMediaPlaylist,
+			want: &HLSPlaylist{
+				Version:        7,
+				TargetDuration: 2,
+				MediaSequence:  10,
+				Segments: []HLSSegment{
+					{URI: "media.mp4", Duration: 2, Sequence: 10, ByteRange: &HLSByteRange{Length: 500, Offset: 100}, Key: key, Map: initmap},
+					{URI: "media.mp4", Duration: 1.5, Sequence: 11, ByteRange: &HLSByteRange{Length: 400, Offset: 600}, Key: key, Map: initmap},
+					{URI: "segment_2.m4s", Duration: 2, Sequence: 12, Map: initmap},
+				},
+			},
+		},
+		{
+			name:     "master playlist",
+			manifest: testHLSMasterPlaylist,
+			want: &HLSPlaylist{
+				Variants: []HLSVariant{
+					{URI: "low/video.m3u8", Bandwidth: 800000, Codecs: "avc1.64001f,mp4a.40.2", Audio: "aac"},
+					{URI: "high/video.m3u8", Bandwidth: 2400000, Codecs: "avc1.640028,mp4a.40.2", Audio: "aac"},
+				},
+				Renditions: []HLSRendition{
+					{Type: "AUDIO", GroupID: "aac", Name: "English", Language: "en", URI: "audio/en.m3u8", Default: true},
+					{Type: "AUDIO", GroupID: "aac", Name: "Deutsch", Language: "de", URI: "audio/de.m3u8"},
+				},
+			},
+		},
+		{name: "missing header", manifest: "#EXTINF:2,\nsegment.ts\n", err: "#EXTM3U"},
+		{name: "bad duration", manifest: "#EXTM3U\n#EXTINF:abc,\nsegment.ts\n", err: "duration"},
+		{name: "bad media sequence", manifest: "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:x\n", err: "media sequence"},
+		{name: "negative offset", manifest: "#EXTM3U\n#EXTINF:2,\n#EXT-X-BYTERANGE:10@-5\nsegment.ts\n", err: "byte range"},
+		{name: "negative length", manifest: "#EXTM3U\n#EXTINF:2,\n#EXT-X-BYTERANGE:-10@0\nsegment.ts\n", err: "byte range"},
+		{name: "empty length", manifest: "#EXTM3U\n#EXTINF:2,\n#EXT-X-BYTERANGE:0@0\nsegment.ts\n", err: "byte range"},
+		{name: "overflowing range", manifest: "#EXTM3U\n#EXTINF:2,\n#EXT-X-BYTERANGE:10@9223372036854775800\nsegment.ts\n", err: "byte range"},
+		{name: "range without a previous range", manifest: "#EXTM3U\n#EXTINF:2,\n#EXT-X-BYTERANGE:10\nsegment.ts\n", err: "no offset"},
+		{name: "map range without an offset", manifest: "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"10\"\n", err: "offset"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			playlist, err := ParseHLSPlaylist([]byte(test.manifest))
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(playlist, test.want) {
+				t.Fatalf("got %+v\nwant %+v", playlist, test.want)
+			}
+		})
+	}
+}
+
+func TestFetchHLSResourceByteRange(t *testing.T) {
+	registerTestFetcher(t, "hlstest", MemoryFetcher{"hlstest://cdn/media.mp4": []byte("0123456789")})
+
+	// the memory fetcher ignores the range header like some servers do, so the range is cut locally
+	data, err := fetchHLSResource("hlstest://cdn/media.mp4", &HLSByteRange{Length: 4, Offset: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "3456" {
+		t.Fatalf("got %q", data)
+	}
+
+	for _, byterange := range []HLSByteRange{{Length: 4, Offset: 8}, {Length: 10, Offset: -5}, {Length: 0, Offset: 0}, {Length: 4, Offset: 11}} {
+		if _, err := fetchHLSResource("hlstest://cdn/media.mp4", &byterange); err == nil {
+			t.Errorf("%d@%d: expected an error", byterange.Length, byterange.Offset)
+		}
+	}
+}
+
+func TestTrackID(t *testing.T) {
+	ids := map[string]bool{}
+	for idx, groupid := range []string{"", "aac", "aac"} {
+		id := trackID("audio", groupid, idx)
+		if ids[id] {
+			t.Fatalf("%s is used twice", id)
+		}
+		ids[id] = true
+	}
+
+	if id := trackID("audio", "../a b", 1); id != "master_audio_ab_1" {
+		t.Fatalf("got %q", id)
+	}
+
+	if id := trackID("audio", "audio_en", 2); id != "master_audio_audio_en_2" {
+		t.Fatalf("got %q", id)
+	}
+}
+
+// FuzzParseHLSPlaylist checks that parsed playlists only hold byte ranges the downloader can slice.
+func FuzzParseHLSPlaylist(f *testing.F) {
+	f.Add([]byte(testHLSMediaPlaylist))
+	f.Add([]byte(testHLSMasterPlaylist))
+	f.Add([]byte("#EXTM3U\n#EXT-X-BYTERANGE:10@-5\nsegment.ts\n"))
+	f.Add([]byte("#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"5@0\n"))
+	f.Add([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n"))
+	f.Add([]byte(""))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		playlist, err := ParseHLSPlaylist(data)
+		if err != nil {
+			return
+		}
+
+		for _, segment := range playlist.Segments {
+			if len(segment.URI) == 0 {
+				t.Fatal("segment without an uri")
+			}
+
+			for _, byterange := range []*HLSByteRange{segment.ByteRange, mapByteRange(segment.Map)} {
+				if byterange != nil && (byterange.Length <= 0 || byterange.Offset < 0 || byterange.Offset+byterange.Length < 0) {
+					t.Fatalf("invalid byte range %d@%d", byterange.Length, byterange.Offset)
+				}
+			}
+		}
+
+		for _, variant := range playlist.Variants {
+			hlsContentType(variant.Codecs, "video")
+		}
+	})
+}
+
+func mapByteRange(initmap *HLSMap) *HLSByteRange {
+	if initmap == nil {
+		return nil
+	}
+	return initmap.ByteRange
+}
@@ -1,131 +1,549 @@
 package main
 
 import (
-	"blurlconvert/blurldecrypt"
-	"encoding/base64"
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"math"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var (
+	emitHLS      = flag.Bool("emit-hls", false, "write fMP4 HLS media and master playlists for the downloaded tracks to hls in the output directory")
+	checksums    = flag.Bool("checksums", false, "write a sha256 manifest of every segment and output next to the result")
+	progressMode = flag.String("progress", "auto", "progress output: auto (bar when stdout is a terminal), bar, json (events on stdout, messages on stderr) or none")
+	jsonResult   = flag.Bool("json", false, "print a json document describing the run to stdout when it finishes, messages go to stderr")
+	jsonOut      = flag.String("json-out", "", "write the json result document to this file instead of stdout")
+	redactKey    = flag.Bool("redact-key", false, "leave the content key out of the json result")
+	outputDir    = flag.String("output-dir", ".", "directory the finished outputs are moved to")
+	nameTemplate = flag.String("name-template", "", "output name without extension, placeholders: {kid} {kid62} {language} {type} {codec} {input_basename}")
+	onCollision  = flag.String("on-collision", "overwrite", "what to do when an output already exists: overwrite, skip or suffix")
+	workDir      = flag.String("work-dir", "", "directory for intermediate files, defaults to a fresh temporary directory per run")
+	keyPaths     pathListFlag
+	bearerFlag   = flag.String("bearer", "", "bearer token for envelopes that are decrypted with it, defaults to BLURLCONVERT_BEARER")
+	bearerFile   = flag.String("bearer-file", "", "read the bearer token from this file")
+	contentKeys  = NewContentKeys()
+	keyFile      = flag.String("key-file", "", "json web key set or kid:key lines with content keys, skips the envelope")
+	keyCachePath = flag.String("key-cache", "", "file remembering content keys by kid and nonce, defaults to keycache.json in the user cache dir")
+	noKeyCache   = flag.Bool("no-key-cache", false, "neither read nor write the content key cache")
+	offline      = flag.String("offline", "", "resolve manifests and segments from a directory (or a tar/zip of it) created by the mirror command instead of the network")
+)
+
 func main() {
-	if len(os.Args) <= 2 {
+	if len(os.Args) > 1 && os.Args[1] == "mirror" {
+		RunMirror(os.Args[2:])
 		return
 	}
 
-	if !strings.HasSuffix(os.Args[1], ".blurl") && !strings.HasSuffix(os.Args[1], ".json") {
-		fmt.Println("input must be a blurl or a json")
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		RunKeys(os.Args[2:])
 		return
 	}
 
-	var blurl BLURL
+	httpflags := addHTTPFlags(flag.CommandLine)
+
+	flag.Var(contentKeys, "key", "content key as <kid>:<key> in hex, skips the envelope (repeatable)")
+	flag.Var(&keyPaths, "keys", "key store to search before the default locations, a list separated like PATH (repeatable)")
+
+	flag.Parse()
+
+	jsontostdout := (*jsonResult && len(*jsonOut) == 0) || *jsonOut == "-"
+
+	if jsontostdout && *progressMode == "json" {
+		fmt.Println("-json and -progress json can't both write to stdout, send the result elsewhere with -json-out")
+		os.Exit(1)
+	}
+
+	if jsontostdout || *progressMode == "json" {
+		reserveStdout()
+	}
 
-	if strings.HasSuffix(os.Args[1], ".blurl") {
-		err := parseBLURL(&blurl, string(os.Args[1]))
+	err := httpflags.apply()
+	if err != nil {
+		fmt.Println("Error configuring http:", err)
+		os.Exit(1)
+	}
 
+	if len(*keyFile) > 0 {
+		err = contentKeys.LoadFile(*keyFile)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Println("Error loading key file:", err)
+			os.Exit(1)
 		}
-	} else {
-		err := parseBLURLFromJSON(&blurl, string(os.Args[1]))
+	}
+
+	switch *onCollision {
+	case "overwrite", "skip", "suffix":
+	default:
+		fmt.Printf("unknown -on-collision policy %q\n", *onCollision)
+		os.Exit(1)
+	}
+
+	progress, err = NewProgress(*progressMode)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var offlinefetcher io.Closer
+
+	if len(*offline) > 0 {
+		fetcher, err := NewOfflineFetcher(*offline)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Println("Error opening offline mirror:", err)
+			os.Exit(1)
+		}
+
+		if closer, ok := fetcher.(io.Closer); ok {
+			offlinefetcher = closer
 		}
+
+		RegisterFetcher("http", fetcher)
+		RegisterFetcher("https", fetcher)
 	}
 
-	var mediaurl string
-	if len(blurl.Playlists) == 1 {
-		mediaurl = blurl.Playlists[0].URL
-	} else {
-		mediaurl = GetMediaURL(&blurl)
+	result := NewRunResult(flag.Arg(0))
+
+	err = run(flag.Arg(0), result)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// os.Exit skips deferred calls, so the archive is closed here
+	if offlinefetcher != nil {
+		offlinefetcher.Close()
+	}
+
+	result.Finish(err)
+
+	if *jsonResult || len(*jsonOut) > 0 {
+		writeerr := result.Write(*jsonOut)
+		if writeerr != nil {
+			fmt.Println("Error writing result:", writeerr)
+			os.Exit(1)
+		}
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func run(input string, result *RunResult) error {
+	blurl, err := LoadBLURL(input)
+	if err != nil {
+		return err
+	}
+
+	playlist := GetPlaylist(&blurl)
+	if playlist == nil {
+		return errors.New("no playlist selected")
+	}
+
+	result.SetPlaylist(playlist)
+
+	mediaurl, err := RemoveDuplicateUUIDPath(playlist.URL)
+	if err != nil {
+		return fmt.Errorf("Error parsing playlist url: %v", err)
 	}
 
-	var key []byte
+	workdir, err := createWorkDir(*workDir)
+	if err != nil {
+		return fmt.Errorf("Error creating work directory: %v", err)
+	}
+	defer cleanupWorkDir(workdir, *workDir)
+
+	manifeststart := time.Now()
+
+	var contenttype string
+
+	manifest, err := GetInlineManifest(playlist)
+	if err != nil {
+		return fmt.Errorf("Error decoding inline playlist data: %v", err)
+	}
+
+	inline := manifest != nil
 
-	if len(blurl.Ev) > 0 {
-		decodedEV, err := base64.StdEncoding.DecodeString(blurl.Ev)
+	// only go to the network when the blurl doesn't carry the manifest itself
+	if !inline {
+		manifest, contenttype, err = fetchManifest(mediaurl)
 		if err != nil {
-			fmt.Println("Error decoding base64:", err)
-			return
+			return fmt.Errorf("Error getting playlist metadata: %v", err)
 		}
+	}
 
-		parsedev, err := blurldecrypt.ParseEV(decodedEV)
+	result.Timings.ManifestSeconds = secondsSince(manifeststart)
 
-		key = blurldecrypt.GetEncryptionKey("keys.bin", parsedev.Nonce, parsedev.Key[:])
+	ishls := IsHLSManifest(playlist, contenttype, manifest)
 
-		if key == nil {
-			return
+	// the kids of a dash manifest are known before any key is, so the key cache can be asked first
+	var mpddata *MPD
+	var kids []string
+
+	if !ishls {
+		mpddata, err = ParseMPD(manifest)
+		if err != nil {
+			return fmt.Errorf("Error getting playlist metadata: %v", err)
 		}
 
-		fmt.Printf("Key: %02x\n", key)
+		for idx := range mpddata.Period.AdaptationSet {
+			kids = append(kids, GetDefaultKID(mpddata, idx))
+		}
 	}
 
-	mediaurl, err := RemoveDuplicateUUIDPath(mediaurl)
+	keycache := openKeyCache()
 
-	mpddata, err := GetPlaylistMetadataByID(mediaurl)
+	keystart := time.Now()
 
+	keys, nonce, err := resolveKeys(&blurl, kids, keycache)
 	if err != nil {
-		fmt.Println("Error getting playlist metadata:", err)
-		return
+		return err
 	}
 
-	trackduration := GetPlaylistDuration(mpddata)
+	result.Timings.KeySeconds = secondsSince(keystart)
+	result.SetKey(keys.Key(""), *redactKey)
 
-	if trackduration < 0 {
-		fmt.Println("Track Duration is 0 exiting!")
-		return
+	if ishls {
+		result.Format = "hls"
+
+		err = ProcessHLSPlaylist(workdir, mediaurl, manifest, keys.Key(""), blurl.AudioOnly, *checksums, result)
+		if err != nil {
+			return fmt.Errorf("Error Processing HLS Playlist: %v", err)
+		}
+
+		cacheKey(keycache, "", nonce, keys.Default)
+
+		return nil
+	}
+
+	result.Format = "dash"
+
+	for idx, kid := range kids {
+		// a protected track without a key would be muxed still encrypted
+		if len(kid) > 0 && keys.Key(kid) == nil {
+			return fmt.Errorf("no content key for the %s track with kid %s, pass one with -key or -key-file", mpddata.Period.AdaptationSet[idx].ContentType, kid)
+		}
 	}
 
-	segmentDurationStr := mpddata.Period.AdaptationSet[0].Representation[0].SegmentTemplate.Duration
-	segmentDuration, err := strconv.ParseInt(segmentDurationStr, 10, 64)
+	result.SetKey(keys.Key(GetDefaultKID(mpddata, 0)), *redactKey)
+
+	err = ProcessDASHPlaylist(workdir, mpddata, mediaurl, inline, keys, result)
 	if err != nil {
-		fmt.Println("Error parsing segment duration:", err)
-		return
+		return err
+	}
+
+	// only keys that decrypted their tracks are remembered
+	for _, kid := range kids {
+		trackkey := keys.Key(kid)
+
+		// a key that only matched as the default is cached under the kid just when a key store
+		// envelope vouches for it, a default from a license may belong to another track entirely
+		switch {
+		case keys.Has(kid):
+			cacheKey(keycache, kid, "", trackkey)
+		case len(nonce) > 0 && bytes.Equal(trackkey, keys.Default):
+			cacheKey(keycache, kid, nonce, trackkey)
+		}
+	}
+
+	return nil
+}
+
+// resolveKeys collects the content keys for the kids of a run and returns the envelope nonce if the
+// envelope was unwrapped. Keys given with -key or -key-file come first, the key cache fills in the
+// other kids and the envelope is only unwrapped for kids neither of them knows, a failed unwrap
+// just leaves those kids without a key when the cache found any.
+func resolveKeys(blurl *BLURL, kids []string, keycache *KeyCache) (*ContentKeys, string, error) {
+	keys := NewContentKeys()
+	for kid, key := range contentKeys.ByKID {
+		keys.ByKID[kid] = key
 	}
-	timescaleStr := mpddata.Period.AdaptationSet[0].Representation[0].SegmentTemplate.Timescale
-	timescale, err := strconv.ParseInt(timescaleStr, 10, 64)
+
+	flagkeys := !keys.Empty()
+	if flagkeys {
+		fmt.Printf("Using the content keys for %s\n", keys)
+	}
+
+	hits, missing := 0, 0
+	for _, kid := range kids {
+		if len(kid) == 0 || keys.Has(kid) {
+			continue
+		}
+
+		if cached := keycache.ByKID(kid); cached != nil {
+			fmt.Printf("Key for %s found in cache: %s\n", kid, displayKey(cached))
+			keys.Add(kid, cached)
+			hits++
+			continue
+		}
+
+		missing++
+	}
+
+	if flagkeys || len(blurl.Ev) == 0 || (hits > 0 && missing == 0) {
+		return keys, "", nil
+	}
+
+	var nonce string
+
+	bearer, err := bearerToken(*bearerFlag, *bearerFile)
 	if err != nil {
-		fmt.Println("Error parsing timescale:", err)
-		return
+		err = fmt.Errorf("Error reading bearer token: %v", err)
+	} else {
+		nonce, err = unwrapEnvelope(blurl.Ev, bearer, keycache, keys)
+	}
+
+	if err != nil {
+		if hits == 0 {
+			return nil, "", err
+		}
+
+		fmt.Println("Error unwrapping the envelope, continuing with the cached keys:", err)
+		return keys, "", nil
+	}
+
+	if keys.Default != nil {
+		fmt.Printf("Key: %s\n", displayKey(keys.Default))
+	}
+
+	return keys, nonce, nil
+}
+
+func ProcessDASHPlaylist(workdir string, mpddata *MPD, mediaurl string, inline bool, keys *ContentKeys, result *RunResult) error {
+	trackduration := GetPlaylistDuration(mpddata)
+
+	numberOfSegments, err := GetSegmentCount(mpddata)
+	if err != nil {
+		return fmt.Errorf("Error getting segment count: %v", err)
+	}
+
+	if numberOfSegments <= 0 {
+		return errors.New("Invalid number of track segments! exiting.")
+	}
+
+	result.Duration = trackduration
+	result.SegmentCount = int(numberOfSegments)
+	result.KeyID = GetDefaultKID(mpddata, 0)
+
+	fmt.Printf("===================================================================================\n")
+	fmt.Printf("Track Segments: %.0f\n", numberOfSegments)
+	fmt.Printf("Media Type: %s\n", mpddata.Period.AdaptationSet[0].ContentType)
+	fmt.Printf("Media Codec: %s\n", mpddata.Period.AdaptationSet[0].Representation[0].Codecs)
+	fmt.Printf("Sample Rate: %skHz\n", mpddata.Period.AdaptationSet[0].Representation[0].AudioSamplingRate)
+	fmt.Printf("===================================================================================\n")
+
+	var hlsdir string
+	var hlstracks []HLSTrack
+	var checksummanifest *ChecksumManifest
+	var outputs []string
+
+	if *checksums {
+		checksummanifest = &ChecksumManifest{}
 	}
 
-	numberOfSegments := math.Ceil(trackduration / (float64(segmentDuration) / float64(timescale)))
+	// packaged in the work dir and only moved to the output directory once every playlist is written
+	if *emitHLS {
+		hlsdir = filepath.Join(workdir, "hls")
 
-	if numberOfSegments > 0 {
-		fmt.Printf("===================================================================================\n")
-		fmt.Printf("Track Segments: %.0f\n", numberOfSegments)
-		fmt.Printf("Media Type: %s\n", mpddata.Period.AdaptationSet[0].ContentType)
-		fmt.Printf("Media Codec: %s\n", mpddata.Period.AdaptationSet[0].Representation[0].Codecs)
-		fmt.Printf("Sample Rate: %skHz\n", mpddata.Period.AdaptationSet[0].Representation[0].AudioSamplingRate)
-		fmt.Printf("===================================================================================\n")
+		err = os.RemoveAll(hlsdir)
+		if err != nil {
+			return fmt.Errorf("Error Clearing HLS Directory: %v", err)
+		}
+	}
+
+	downloadstart := time.Now()
+
+	for idx, adaptation := range mpddata.Period.AdaptationSet {
+		initmp4 := GetInitName(idx, mpddata)
+		trackkey := hex.EncodeToString(keys.Key(GetDefaultKID(mpddata, idx)))
+		trackstart := time.Now()
+
+		// named after the representation so two adaptation sets of one content type stay apart
+		id := trackID(adaptation.ContentType, adaptation.Representation[0].ID, idx)
+
+		segments, err := HandleDownloadTrack(workdir, adaptation.ContentType, id, numberOfSegments, GetMPDBaseURL(mpddata, mediaurl, inline), initmp4, adaptation.Representation[0].ID, trackkey, checksummanifest)
+
+		if err != nil {
+			return fmt.Errorf("Error Downloading Track: %v", err)
+		}
+
+		output := filepath.Join(workdir, fmt.Sprintf("%s.mp4", id))
+		outputs = append(outputs, output)
+
+		bandwidth, _ := strconv.ParseInt(adaptation.Representation[0].Bandwidth, 10, 64)
 
-		for _, adaptation := range mpddata.Period.AdaptationSet {
-			err := HandleDownloadTrack(adaptation.ContentType, fmt.Sprintf("master_%s", adaptation.ContentType), numberOfSegments, getBaseURL(mediaurl), strings.ReplaceAll(adaptation.Representation[0].SegmentTemplate.Initialization, "$RepresentationID$", adaptation.Representation[0].ID), adaptation.Representation[0].ID, hex.EncodeToString(key))
+		result.Tracks = append(result.Tracks, TrackResult{
+			ContentType:     adaptation.ContentType,
+			Language:        adaptation.Lang,
+			Codecs:          adaptation.Representation[0].Codecs,
+			Bandwidth:       bandwidth,
+			SampleRate:      adaptation.Representation[0].AudioSamplingRate,
+			KeyID:           GetDefaultKID(mpddata, idx),
+			Segments:        len(segments),
+			Output:          output,
+			DownloadSeconds: secondsSince(trackstart),
+		})
 
+		// packaged from the decrypted output so the playlists need no key
+		if *emitHLS {
+			track, err := NewHLSTrack(mpddata, idx)
 			if err != nil {
-				fmt.Println("Error Downloading Track", err)
-				return
+				return fmt.Errorf("Error Creating HLS Track: %v", err)
 			}
+
+			err = PackageHLSTrack(hlsdir, &track, output)
+			if err != nil {
+				return fmt.Errorf("Error Packaging HLS Track: %v", err)
+			}
+
+			hlstracks = append(hlstracks, track)
 		}
+	}
+
+	result.Timings.DownloadSeconds = secondsSince(downloadstart)
 
-		/*Scuffed but works */
-		if len(mpddata.Period.AdaptationSet) == 2 {
-			Merge("master_video.mp4", "master_audio.mp4", EncodeToBase62(mpddata.Period.AdaptationSet[0].ContentProtection[0].DefaultKID)[:8])
+	if *emitHLS {
+		err = WriteHLSMasterPlaylist(hlsdir, hlstracks)
+		if err != nil {
+			return fmt.Errorf("Error Writing HLS Master Playlist: %v", err)
 		}
+	}
 
-		time.Sleep(1 * time.Second)
+	inputbasename := strings.TrimSuffix(filepath.Base(result.Input), filepath.Ext(result.Input))
 
-		os.RemoveAll("./downloads")
+	var pending []pendingOutput
+	videoidx, audioidx := -1, -1
+	for idx, track := range result.Tracks {
+		if track.ContentType == "video" && videoidx == -1 {
+			videoidx = idx
+		}
+		if track.ContentType == "audio" && audioidx == -1 {
+			audioidx = idx
+		}
 
-	} else {
-		fmt.Println("Invalid number of track segments! exiting.")
+		pending = append(pending, pendingOutput{Path: outputs[idx], Fields: NameFields{
+			KID:           track.KeyID,
+			Language:      firstNonEmpty(track.Language, result.Playlist.Language),
+			Type:          track.ContentType,
+			Codec:         track.Codecs,
+			InputBasename: inputbasename,
+		}})
+	}
+
+	merged := ""
+
+	// only a single video and audio pair is muxed, every other track is kept on its own
+	if len(result.Tracks) == 2 && videoidx != -1 && audioidx != -1 {
+		mergestart := time.Now()
+
+		mergename := result.Tracks[videoidx].KeyID
+		if len(mergename) == 0 {
+			mergename = mediaurl
+		}
+
+		merged = Merge(workdir, outputs[videoidx], outputs[audioidx], kid62(mergename))
+		if len(merged) > 0 {
+			pending = []pendingOutput{{Path: merged, Fields: NameFields{
+				KID:           result.Tracks[videoidx].KeyID,
+				Language:      firstNonEmpty(result.Tracks[audioidx].Language, result.Tracks[videoidx].Language, result.Playlist.Language),
+				Type:          "muxed",
+				Codec:         result.Tracks[videoidx].Codecs,
+				InputBasename: inputbasename,
+			}}}
+		}
+
+		result.Timings.MergeSeconds = secondsSince(mergestart)
+	}
+
+	err = finishOutputs(pending, merged, checksummanifest, result)
+	if err != nil {
+		return fmt.Errorf("Error Placing Outputs: %v", err)
+	}
+
+	if *emitHLS {
+		result.HLS, err = placeDir(outputNamer(), hlsdir, "hls")
+		if err != nil {
+			return fmt.Errorf("Error Placing HLS Output: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func outputNamer() *OutputNamer {
+	return &OutputNamer{
+		Dir:       *outputDir,
+		Template:  *nameTemplate,
+		Collision: *onCollision,
+	}
+}
+
+func openKeyCache() *KeyCache {
+	if *noKeyCache {
+		return nil
+	}
+
+	path := *keyCachePath
+	if len(path) == 0 {
+		path = defaultKeyCachePath()
+	}
+	if len(path) == 0 {
+		return nil
+	}
+
+	cache, err := LoadKeyCache(path)
+	if err != nil {
+		fmt.Println("Error loading key cache, continuing without it:", err)
+		return nil
+	}
+
+	return cache
+}
+
+// displayKey is how a content key shows up in messages, hidden the same way as in the result with
+// -redact-key.
+func displayKey(key []byte) string {
+	if *redactKey {
+		return "redacted"
+	}
+
+	return hex.EncodeToString(key)
+}
+
+func cacheKey(cache *KeyCache, kid string, nonce string, key []byte) {
+	err := cache.Put(kid, nonce, key)
+	if err != nil {
+		fmt.Println("Error saving key cache:", err)
+	}
+}
+
+// createWorkDir gives every run its own directory for downloads and intermediate files so that
+// concurrent runs never share state, an explicit -work-dir is used as is.
+func createWorkDir(dir string) (string, error) {
+	if len(dir) > 0 {
+		return dir, os.MkdirAll(dir, 0755)
+	}
+
+	return os.MkdirTemp("", "blurlconvert-*")
+}
+
+func cleanupWorkDir(workdir string, requested string) {
+	// only the downloads of a user provided work dir are ours to delete
+	if len(requested) > 0 {
+		os.RemoveAll(filepath.Join(workdir, "downloads"))
 		return
 	}
+
+	os.RemoveAll(workdir)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var errMirrorNotFound = errors.New("not found on cdn")
+
+// MirrorURL downloads rawurl into the mirror directory unless it is already there and returns the local path.
+func MirrorURL(dir string, rawurl string) (string, error) {
+	localpath, err := MirrorPath(dir, rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(localpath); err == nil {
+		return localpath, nil
+	}
+
+	resp, err := fetchURL(rawurl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errMirrorNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status while mirroring %s: %s", rawurl, resp.Status)
+	}
+
+	err = os.MkdirAll(filepath.Dir(localpath), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a temp file first so an interrupted mirror never leaves a truncated file behind
+	tmpfile, err := os.CreateTemp(filepath.Dir(localpath), ".mirror-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = io.Copy(tmpfile, resp.Body)
+	if err != nil {
+		tmpfile.Close()
+		return "", err
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return localpath, os.Rename(tmpfile.Name(), localpath)
+}
+
+func mirrorURLs(dir string, urls []string, optionallast bool) error {
+	var wg sync.WaitGroup
+	var errmu sync.Mutex
+	var mirrorerr error
+
+	work := make(chan int)
+
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				_, err := MirrorURL(dir, urls[idx])
+
+				// the segment count is rounded up so the cdn doesn't always have the last one
+				if errors.Is(err, errMirrorNotFound) && optionallast && idx == len(urls)-1 {
+					continue
+				}
+
+				if err != nil {
+					errmu.Lock()
+					if mirrorerr == nil {
+						mirrorerr = fmt.Errorf("%s: %v", urls[idx], err)
+					}
+					errmu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for idx := range urls {
+		work <- idx
+	}
+	close(work)
+
+	wg.Wait()
+
+	return mirrorerr
+}
+
+func mirrorDASH(dir string, mpddata *MPD, mediaurl string, inline bool) error {
+	numberOfSegments, err := GetSegmentCount(mpddata)
+	if err != nil {
+		return err
+	}
+
+	baseurl := GetMPDBaseURL(mpddata, mediaurl, inline)
+
+	for idx, adaptation := range mpddata.Period.AdaptationSet {
+		initmp4 := GetInitName(idx, mpddata)
+
+		urls := []string{baseurl + initmp4}
+		for segment := 1; segment <= int(numberOfSegments); segment++ {
+			urls = append(urls, baseurl+GetSegmentName(initmp4, adaptation.Representation[0].ID, segment))
+		}
+
+		fmt.Printf("Mirroring %s track (%d files)\n", adaptation.ContentType, len(urls))
+
+		err = mirrorURLs(dir, urls, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mirrorHLS(dir string, playlisturl string, manifest []byte) error {
+	playlist, err := ParseHLSPlaylist(manifest)
+	if err != nil {
+		return err
+	}
+
+	var children []string
+	for _, variant := range playlist.Variants {
+		children = append(children, variant.URI)
+	}
+	for _, rendition := range playlist.Renditions {
+		if len(rendition.URI) > 0 {
+			children = append(children, rendition.URI)
+		}
+	}
+
+	for _, child := range children {
+		childurl, err := resolveURL(playlisturl, child)
+		if err != nil {
+			return err
+		}
+
+		localpath, err := MirrorURL(dir, childurl)
+		if err != nil {
+			return err
+		}
+
+		childmanifest, err := os.ReadFile(localpath)
+		if err != nil {
+			return err
+		}
+
+		err = mirrorHLS(dir, childurl, childmanifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	var urls []string
+
+	addURI := func(uri string) error {
+		resolved, err := resolveURL(playlisturl, uri)
+		if err != nil {
+			return err
+		}
+		// key uris like skd:// can't be mirrored
+		if !strings.HasPrefix(resolved, "http://") && !strings.HasPrefix(resolved, "https://") {
+			return nil
+		}
+		if !seen[resolved] {
+			seen[resolved] = true
+			urls = append(urls, resolved)
+		}
+		return nil
+	}
+
+	for _, segment := range playlist.Segments {
+		if segment.Map != nil {
+			if err := addURI(segment.Map.URI); err != nil {
+				return err
+			}
+		}
+		if segment.Key != nil && len(segment.Key.URI) > 0 {
+			if err := addURI(segment.Key.URI); err != nil {
+				return err
+			}
+		}
+		if err := addURI(segment.URI); err != nil {
+			return err
+		}
+	}
+
+	if len(urls) > 0 {
+		fmt.Printf("Mirroring %s (%d files)\n", playlisturl, len(urls))
+	}
+
+	return mirrorURLs(dir, urls, false)
+}
+
+// RunMirror implements the mirror command which copies the manifest and every segment of a blurl
+// into a directory tree that --offline can run against.
+func RunMirror(args []string) {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	dir := flags.String("dir", "mirror", "directory to mirror the cdn paths into")
+	httpflags := addHTTPFlags(flags)
+	flags.Parse(args)
+
+	err := httpflags.apply()
+	if err != nil {
+		fmt.Println("Error configuring http:", err)
+		return
+	}
+
+	if flags.NArg() < 1 {
+		fmt.Println("usage: blurlconvert mirror [-dir mirror] <input.blurl|input.json>")
+		return
+	}
+
+	blurl, err := LoadBLURL(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	playlist := GetPlaylist(&blurl)
+	if playlist == nil {
+		return
+	}
+
+	mediaurl, err := RemoveDuplicateUUIDPath(playlist.URL)
+	if err != nil {
+		fmt.Println("Error parsing playlist url:", err)
+		return
+	}
+
+	manifest, err := GetInlineManifest(playlist)
+	if err != nil {
+		fmt.Println("Error decoding inline playlist data:", err)
+		return
+	}
+
+	inline := manifest != nil
+
+	if !inline {
+		localpath, err := MirrorURL(*dir, mediaurl)
+		if err != nil {
+			fmt.Println("Error mirroring playlist:", err)
+			return
+		}
+
+		manifest, err = os.ReadFile(localpath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if IsHLSManifest(playlist, "", manifest) {
+		err = mirrorHLS(*dir, mediaurl, manifest)
+	} else {
+		var mpddata *MPD
+		mpddata, err = ParseMPD(manifest)
+		if err == nil {
+			err = mirrorDASH(*dir, mpddata, mediaurl, inline)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Error mirroring playlist:", err)
+		return
+	}
+
+	fmt.Printf("Mirrored to %s\n", *dir)
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -51,6 +55,7 @@ type MPD struct {
 			Text               string `xml:",chardata"`
 			ID                 string `xml:"id,attr"`
 			ContentType        string `xml:"contentType,attr"`
+			Lang               string `xml:"lang,attr"`
 			StartWithSAP       string `xml:"startWithSAP,attr"`
 			SegmentAlignment   string `xml:"segmentAlignment,attr"`
 			BitstreamSwitching string `xml:"bitstreamSwitching,attr"`
@@ -89,14 +94,6 @@ type MPD struct {
 	} `xml:"Period"`
 }
 
-func isDirExists(path string) bool {
-	info, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return false
-	}
-	return info.IsDir()
-}
-
 const base62 = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func EncodeToBase62(s string) string {
@@ -127,6 +124,36 @@ func getBaseURL(fullURL string) string {
 	return fmt.Sprintf("%s://%s%s/", parsedURL.Scheme, parsedURL.Host, basePath)
 }
 
+// GetMPDBaseURL returns the directory of the manifest url segments are fetched from. Only inline
+// manifests, or manifests without a usable url, fall back to the BaseURL they carry, resolved
+// against the manifest url.
+func GetMPDBaseURL(mpddata *MPD, mediaurl string, inline bool) string {
+	baseurl := strings.TrimSpace(mpddata.BaseURL)
+	if len(baseurl) == 0 || (!inline && isUsableURL(mediaurl)) {
+		return getBaseURL(mediaurl)
+	}
+
+	resolved, err := resolveURL(mediaurl, baseurl)
+	if err != nil {
+		return getBaseURL(mediaurl)
+	}
+
+	if !strings.HasSuffix(resolved, "/") {
+		return getBaseURL(resolved)
+	}
+
+	return resolved
+}
+
+func isUsableURL(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+
+	return len(u.Scheme) > 0 && (len(u.Host) > 0 || len(u.Path) > 0)
+}
+
 func RemoveDuplicateUUIDPath(inputURL string) (string, error) {
 	u, err := url.Parse(inputURL)
 	if err != nil {
@@ -152,27 +179,56 @@ func RemoveDuplicateUUIDPath(inputURL string) (string, error) {
 	return u.String(), nil
 }
 
-func GetPlaylistMetadataByID(url string) (*MPD, error) {
-	res, err := http.Get(url)
+func fetchManifest(url string) ([]byte, string, error) {
+	res, err := fetchURL(url)
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	defer res.Body.Close()
 
+	// a 404 or an offline miss would otherwise surface as a confusing parse error
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, "", fmt.Errorf("bad status while downloading %s: %s", url, res.Status)
+	}
+
 	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, res.Header.Get("Content-Type"), nil
+}
+
+func GetPlaylistMetadataByID(url string) (*MPD, error) {
+	body, _, err := fetchManifest(url)
 	if err != nil {
 		return nil, err
 	}
 
+	return ParseMPD(body)
+}
+
+func ParseMPD(body []byte) (*MPD, error) {
 	var MPD_Data MPD
 
-	err = xml.Unmarshal(body, &MPD_Data)
+	err := xml.Unmarshal(body, &MPD_Data)
 	if err != nil {
 		return nil, err
 	}
 
+	// everything after this indexes the first representation of every adaptation set
+	if len(MPD_Data.Period.AdaptationSet) == 0 {
+		return nil, errors.New("manifest has no adaptation sets")
+	}
+
+	for idx, adaptation := range MPD_Data.Period.AdaptationSet {
+		if len(adaptation.Representation) == 0 {
+			return nil, fmt.Errorf("adaptation set %d has no representations", idx)
+		}
+	}
+
 	return &MPD_Data, nil
 }
 
@@ -188,134 +244,214 @@ func GetPlaylistDuration(mpddata *MPD) float64 {
 	return duration.Seconds()
 }
 
-func HandleDownloadTrack(mediatype string, id string, numberofsegments float64, baseurl string, initmp4 string, adaptation string, key string) error {
+func GetSegmentName(initmp4 string, adaptation string, index int) string {
+	if initmp4 == "init_0.mp4" {
+		return fmt.Sprintf("segment_0_%d.m4s", index)
+	}
+
+	return fmt.Sprintf("segment_%s_%s_%d.m4s", strings.ReplaceAll(strings.ReplaceAll(initmp4, "init_", ""), fmt.Sprintf("_%s.mp4", adaptation), ""), adaptation, index)
+}
+
+func GetDefaultKID(mpddata *MPD, adaptationidx int) string {
+	for _, protection := range mpddata.Period.AdaptationSet[adaptationidx].ContentProtection {
+		if len(protection.DefaultKID) > 0 {
+			return protection.DefaultKID
+		}
+	}
+
+	return ""
+}
+
+func GetInitName(adaptationidx int, mpddata *MPD) string {
+	representation := mpddata.Period.AdaptationSet[adaptationidx].Representation[0]
+	return strings.ReplaceAll(representation.SegmentTemplate.Initialization, "$RepresentationID$", representation.ID)
+}
+
+func GetSegmentCount(mpddata *MPD) (float64, error) {
+	trackduration := GetPlaylistDuration(mpddata)
+
+	if trackduration <= 0 {
+		return 0, fmt.Errorf("track duration is 0")
+	}
+
+	segmentDurationStr := mpddata.Period.AdaptationSet[0].Representation[0].SegmentTemplate.Duration
+	segmentDuration, err := strconv.ParseInt(segmentDurationStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse segment duration: %v", err)
+	}
+	timescaleStr := mpddata.Period.AdaptationSet[0].Representation[0].SegmentTemplate.Timescale
+	timescale, err := strconv.ParseInt(timescaleStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse timescale: %v", err)
+	}
+
+	if segmentDuration <= 0 || timescale <= 0 {
+		return 0, fmt.Errorf("invalid segment duration %d/%d", segmentDuration, timescale)
+	}
+
+	return math.Ceil(trackduration / (float64(segmentDuration) / float64(timescale))), nil
+}
+
+func HandleDownloadTrack(workdir string, mediatype string, id string, numberofsegments float64, baseurl string, initmp4 string, adaptation string, key string, checksums *ChecksumManifest) ([]string, error) {
 	segmentCount := int(numberofsegments)
 
 	fmt.Println(fmt.Sprintf("%s%s", baseurl, initmp4))
 
-	resp, err := http.Get(fmt.Sprintf("%s%s", baseurl, initmp4))
+	resp, err := fetchURL(fmt.Sprintf("%s%s", baseurl, initmp4))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status while downloading init track: %s", resp.Status)
+		return nil, fmt.Errorf("bad status while downloading init track: %s", resp.Status)
 	}
 
-	if !isDirExists("downloads") {
-		err = os.Mkdir("downloads", 0755)
-		if err != nil {
-			fmt.Println(err)
-		}
+	downloads := filepath.Join(workdir, "downloads")
+
+	err = os.MkdirAll(downloads, 0755)
+	if err != nil {
+		return nil, err
 	}
 
-	mastertrack, err := os.Create(fmt.Sprintf("./downloads/%s", initmp4))
+	mastertrack, err := os.Create(filepath.Join(downloads, initmp4))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer mastertrack.Close()
 
-	_, err = io.Copy(mastertrack, resp.Body)
+	progress.StartTrack(id, segmentCount)
+
+	_, err = io.Copy(mastertrack, progress.Reader(id, resp.Body))
+	if err != nil {
+		return nil, err
+	}
 
 	var wg sync.WaitGroup
-	numfilesdownloaded := 0
-	files := make([]string, 0)
-
-	fdChannel := make(chan int)
-	defer close(fdChannel)
-
-	go func() {
-		for iidx := range fdChannel {
-			numfilesdownloaded += iidx
-			if initmp4 == "init_0.mp4" {
-				files = append(files, fmt.Sprintf("segment_0_%d.m4s", numfilesdownloaded))
-			} else {
-				files = append(files, fmt.Sprintf("segment_en_US_%s_%d.m4s", adaptation, numfilesdownloaded))
-			}
+	var errmu sync.Mutex
+	var downloaderr error
+	downloaded := make([]bool, segmentCount)
+
+	setError := func(err error) {
+		errmu.Lock()
+		defer errmu.Unlock()
+		if downloaderr == nil {
+			downloaderr = err
 		}
-	}()
+	}
 
 	for idx := 0; idx < segmentCount; idx++ {
+		wg.Add(1)
 
 		go func(index int) {
 			defer wg.Done()
 
-			var url string
-			var filename string
-
-			if initmp4 == "init_0.mp4" {
-				url = fmt.Sprintf("%ssegment_0_%d.m4s", baseurl, index+1)
-				filename = fmt.Sprintf("segment_0_%d.m4s", index+1)
-			} else {
-				url = fmt.Sprintf("%ssegment_%s_%s_%d.m4s", baseurl, strings.ReplaceAll(strings.ReplaceAll(initmp4, "init_", ""), fmt.Sprintf("_%s.mp4", adaptation), ""), adaptation, index+1)
-				filename = fmt.Sprintf("segment_%s_%s_%d.m4s", strings.ReplaceAll(strings.ReplaceAll(initmp4, "init_", ""), fmt.Sprintf("_%s.mp4", adaptation), ""), adaptation, index+1)
-			}
+			filename := GetSegmentName(initmp4, adaptation, index+1)
+			url := fmt.Sprintf("%s%s", baseurl, filename)
 
-			resp, err := http.Get(url)
+			resp, err := fetchURL(url)
 			if err != nil {
-				panic(err)
+				setError(err)
+				return
 			}
 			defer resp.Body.Close()
 
-			if resp.StatusCode == 404 && idx == int(numberofsegments) {
-				numberofsegments -= 1
+			if resp.StatusCode == http.StatusNotFound && index == segmentCount-1 {
 				fmt.Println("Hmm that's odd.... let's try to finish the decryption process though")
 				return
 			}
 
-			downloadedfile, err := os.Create(fmt.Sprintf("./downloads/%s", filename))
+			if resp.StatusCode != http.StatusOK {
+				setError(fmt.Errorf("bad status while downloading %s: %s", filename, resp.Status))
+				return
+			}
+
+			downloadedfile, err := os.Create(filepath.Join(downloads, filename))
 			if err != nil {
-				panic(err)
+				setError(err)
+				return
 			}
 
-			_, err = io.Copy(downloadedfile, resp.Body)
+			written, err := io.Copy(downloadedfile, progress.Reader(id, resp.Body))
+			downloadedfile.Close()
 			if err != nil {
-				panic(err)
+				setError(err)
+				return
 			}
-			defer downloadedfile.Close()
 
-			fdChannel <- 1
+			if resp.ContentLength >= 0 && written != resp.ContentLength {
+				setError(fmt.Errorf("%s is truncated: got %d of %d bytes", filename, written, resp.ContentLength))
+				return
+			}
 
+			downloaded[index] = true
+			progress.SegmentDone(id)
 		}(idx)
-		wg.Add(1)
 	}
 
 	wg.Wait()
 
+	progress.FinishTrack(id)
+
+	if downloaderr != nil {
+		return nil, downloaderr
+	}
+
+	files := make([]string, 0, segmentCount)
+	for idx := range downloaded {
+		if downloaded[idx] {
+			files = append(files, GetSegmentName(initmp4, adaptation, idx+1))
+		}
+	}
+
+	var sequencechecker SequenceChecker
+
 	for _, segmentName := range files {
-		file, err := os.Open(fmt.Sprintf("./downloads/%s", segmentName))
+		data, err := os.ReadFile(filepath.Join(downloads, segmentName))
 		if err != nil {
-			fmt.Println("Error opening segment:", err)
-			continue
+			return nil, err
 		}
 
-		_, err = io.Copy(mastertrack, file)
+		sequences, err := ValidateSegment(data)
 		if err != nil {
-			fmt.Println("Error writing segment to master track:", err)
+			return nil, fmt.Errorf("%s failed validation: %v", segmentName, err)
 		}
-		file.Close()
 
-		err = os.Remove(fmt.Sprintf("./downloads/%s", segmentName))
+		err = sequencechecker.Check(segmentName, sequences)
+		if err != nil {
+			return nil, err
+		}
+
+		checksums.Add(fmt.Sprintf("%s/%s", id, segmentName), data)
+
+		_, err = mastertrack.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write segment to master track: %v", err)
+		}
+
+		err = os.Remove(filepath.Join(downloads, segmentName))
 		if err != nil {
 			fmt.Println("Error deleting segment:", err)
 		}
 	}
 
 	if len(key) > 0 {
-		DecryptPlaylist(id, initmp4, key)
+		err = DecryptPlaylist(workdir, id, initmp4, key)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		initfile, err := os.Open(fmt.Sprintf("./downloads/%s", initmp4))
+		initfile, err := os.Open(filepath.Join(downloads, initmp4))
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		final_master, err := os.Create(fmt.Sprintf("master_%s.mp4", mediatype))
+		final_master, err := os.Create(filepath.Join(workdir, fmt.Sprintf("%s.mp4", id)))
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		io.Copy(final_master, initfile)
@@ -325,37 +461,45 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 
 	}
 
-	return nil
+	return files, nil
 }
 
-func DecryptPlaylist(id string, initmp4 string, key string) {
-	cmd := exec.Command("ffmpeg", "-decryption_key", key, "-i", fmt.Sprintf("./downloads/%s", initmp4), "-c", "copy", fmt.Sprintf("%s.mp4", id))
+// ffmpegCommand builds every ffmpeg invocation so the tests can stand in for ffmpeg.
+var ffmpegCommand = exec.Command
+
+func DecryptPlaylist(workdir string, id string, initmp4 string, key string) error {
+	cmd := ffmpegCommand("ffmpeg", "-y", "-decryption_key", key, "-i", filepath.Join(workdir, "downloads", initmp4), "-c", "copy", filepath.Join(workdir, fmt.Sprintf("%s.mp4", id)))
 
 	err := cmd.Run()
 	if err != nil {
-		fmt.Println("Error running ffmpeg command:", err)
-		return
+		return fmt.Errorf("ffmpeg failed to decrypt %s: %v", initmp4, err)
 	}
+
+	return nil
 }
 
-func Merge(videofile string, audiofile string, kid string) {
-	cmd := exec.Command("ffmpeg", "-i", videofile, "-i", audiofile, "-c:v", "copy", "-c:a", "copy", fmt.Sprintf("%s_master.mp4", kid))
+func Merge(workdir string, videofile string, audiofile string, kid string) string {
+	output := filepath.Join(workdir, fmt.Sprintf("%s_master.mp4", kid))
+
+	cmd := ffmpegCommand("ffmpeg", "-i", videofile, "-i", audiofile, "-c:v", "copy", "-c:a", "copy", output)
 
 	err := cmd.Run()
 	if err != nil {
 		fmt.Println("Error running ffmpeg command:", err)
-		return
+		return ""
 	}
 
 	err = os.Remove(videofile)
 	if err != nil {
 		fmt.Println("Error deleting video file:", err)
-		return
+		return output
 	}
 
 	err = os.Remove(audiofile)
 	if err != nil {
 		fmt.Println("Error deleting audio file:", err)
-		return
+		return output
 	}
+
+	return output
 }
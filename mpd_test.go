@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const testMPD = `<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT30.5S" minBufferTime="PT2S">
+  <BaseURL>https://example.com/a/</BaseURL>
+  <Period id="0" start="PT0S">
+    <AdaptationSet id="0" contentType="video" lang="en">
+      <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" default_KID="abcdef12-3456-7890-abcd-ef1234567890"/>
+      <Representation id="0" bandwidth="1000000" mimeType="video/mp4" codecs="avc1.64001f">
+        <SegmentTemplate duration="96000" timescale="48000" initialization="init_$RepresentationID$.mp4" media="segment_$RepresentationID$_$Number$.m4s" startNumber="1"/>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet id="1" contentType="audio" lang="en">
+      <Representation id="1" bandwidth="128000" mimeType="audio/mp4" codecs="mp4a.40.2" audioSamplingRate="48000">
+        <SegmentTemplate duration="96000" timescale="48000" initialization="init_$RepresentationID$.mp4" media="segment_$RepresentationID$_$Number$.m4s" startNumber="1"/>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+// FuzzParseMPD runs every manifest that parses through the helpers the download path calls on it.
+func FuzzParseMPD(f *testing.F) {
+	f.Add([]byte(testMPD))
+	f.Add([]byte(`<MPD mediaPresentationDuration="PT1S"><Period><AdaptationSet><Representation><SegmentTemplate duration="0" timescale="0"/></Representation></AdaptationSet></Period></MPD>`))
+	f.Add([]byte(`<MPD><Period><AdaptationSet/></Period></MPD>`))
+	f.Add([]byte(`<MPD/>`))
+	f.Add([]byte(`<`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mpddata, err := ParseMPD(data)
+		if err != nil {
+			return
+		}
+
+		count, err := GetSegmentCount(mpddata)
+		if err == nil && !(count >= 0) {
+			t.Fatalf("segment count %v", count)
+		}
+
+		GetMPDBaseURL(mpddata, "https://example.com/a/master.mpd", true)
+
+		for idx := range mpddata.Period.AdaptationSet {
+			GetDefaultKID(mpddata, idx)
+			GetSegmentName(GetInitName(idx, mpddata), mpddata.Period.AdaptationSet[idx].Representation[0].ID, 0)
+		}
+	})
+}
+
+func TestParseMPD(t *testing.T) {
+	mpddata, err := ParseMPD([]byte(testMPD))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := GetSegmentCount(mpddata)
+	if err != nil || count != 16 {
+		t.Fatalf("got %v segments, %v", count, err)
+	}
+
+	if kid := GetDefaultKID(mpddata, 0); kid != "abcdef12-3456-7890-abcd-ef1234567890" {
+		t.Fatalf("got kid %q", kid)
+	}
+
+	for _, invalid := range []string{`<MPD/>`, `<MPD><Period><AdaptationSet/></Period></MPD>`} {
+		if _, err := ParseMPD([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestGetMPDBaseURL(t *testing.T) {
+	tests := []struct {
+		baseurl  string
+		mediaurl string
+		inline   bool
+		want     string
+	}{
+		{"", "https://example.com/a/master.mpd", false, "https://example.com/a/"},
+		{"https://cdn.example.com/b/", "https://example.com/a/master.mpd", false, "https://example.com/a/"},
+		{"https://cdn.example.com/b/", "https://example.com/a/master.mpd", true, "https://cdn.example.com/b/"},
+		{"media/", "https://example.com/a/master.mpd", true, "https://example.com/a/media/"},
+		{"https://cdn.example.com/b/", "", false, "https://cdn.example.com/b/"},
+		{"", "https://example.com/a/master.mpd", true, "https://example.com/a/"},
+	}
+
+	for _, test := range tests {
+		got := GetMPDBaseURL(&MPD{BaseURL: test.baseurl}, test.mediaurl, test.inline)
+		if got != test.want {
+			t.Errorf("BaseURL %q, url %q, inline %v: got %q, want %q", test.baseurl, test.mediaurl, test.inline, got, test.want)
+		}
+	}
+}
+
+type goldenTrack struct {
+	ContentType  string `json:"content_type"`
+	Language     string `json:"language"`
+	KID          string `json:"kid"`
+	Init         string `json:"init"`
+	FirstSegment string `json:"first_segment"`
+}
+
+// goldenMPD is what the golden files hold: the parsed model and what the download path derives from it.
+type goldenMPD struct {
+	Model        any           `json:"model"`
+	Duration     float64       `json:"duration"`
+	SegmentCount float64       `json:"segment_count"`
+	BaseURL      string        `json:"base_url"`
+	Tracks       []goldenTrack `json:"tracks"`
+}
+
+// goldenModel is the model as json without the chardata that only holds the indentation between
+// elements, so reformatting a fixture doesn't change its golden file. Text with content is kept trimmed.
+func goldenModel(mpddata *MPD) (any, error) {
+	data, err := json.Marshal(mpddata)
+	if err != nil {
+		return nil, err
+	}
+
+	var model any
+	err = json.Unmarshal(data, &model)
+	if err != nil {
+		return nil, err
+	}
+
+	var strip func(value any)
+	strip = func(value any) {
+		switch value := value.(type) {
+		case map[string]any:
+			if text, ok := value["Text"].(string); ok {
+				if text = strings.TrimSpace(text); len(text) == 0 {
+					delete(value, "Text")
+				} else {
+					value["Text"] = text
+				}
+			}
+			for _, child := range value {
+				strip(child)
+			}
+		case []any:
+			for _, child := range value {
+				strip(child)
+			}
+		}
+	}
+	strip(model)
+
+	return model, nil
+}
+
+func TestMPDGolden(t *testing.T) {
+	manifests, err := filepath.Glob(filepath.Join("testdata", "mpd", "*.mpd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifests) == 0 {
+		t.Fatal("no manifests in testdata/mpd")
+	}
+
+	for _, manifest := range manifests {
+		name := strings.TrimSuffix(filepath.Base(manifest), ".mpd")
+
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mpddata, err := ParseMPD(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			segmentcount, err := GetSegmentCount(mpddata)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			model, err := goldenModel(mpddata)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := goldenMPD{
+				Model:        model,
+				Duration:     GetPlaylistDuration(mpddata),
+				SegmentCount: segmentcount,
+				BaseURL:      GetMPDBaseURL(mpddata, "https://cdn.example.com/content/manifest/master.mpd", true),
+				Tracks:       []goldenTrack{},
+			}
+
+			for idx, adaptation := range mpddata.Period.AdaptationSet {
+				initmp4 := GetInitName(idx, mpddata)
+				golden.Tracks = append(golden.Tracks, goldenTrack{
+					ContentType:  adaptation.ContentType,
+					Language:     adaptation.Lang,
+					KID:          GetDefaultKID(mpddata, idx),
+					Init:         initmp4,
+					FirstSegment: GetSegmentName(initmp4, adaptation.Representation[0].ID, 1),
+				})
+			}
+
+			got, err := json.MarshalIndent(golden, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenfile := filepath.Join("testdata", "mpd", name+".golden.json")
+
+			if *updateGolden {
+				err = os.WriteFile(goldenfile, got, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(goldenfile)
+			if err != nil {
+				t.Fatalf("%v, run go test -run TestMPDGolden -update to create it", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("parsing %s drifted from %s, run go test -run TestMPDGolden -update if the change is intended\n%s", manifest, goldenfile, got)
+			}
+		})
+	}
+}
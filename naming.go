@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NameFields are the values the {placeholders} of a name template expand to.
+type NameFields struct {
+	KID           string
+	Language      string
+	Type          string
+	Codec         string
+	InputBasename string
+}
+
+// OutputNamer decides where a finished output ends up. An empty Template keeps the name the
+// pipeline produced (master_<type>_<id>_<index> per track and <kid62>_master for merged files).
+type OutputNamer struct {
+	Dir       string
+	Template  string
+	Collision string
+}
+
+var errOutputExists = errors.New("output already exists")
+
+func sanitizeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 0x20 {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+func kid62(kid string) string {
+	encoded := EncodeToBase62(kid)
+	if len(encoded) > 8 {
+		return encoded[:8]
+	}
+	return encoded
+}
+
+// trackID names the files of one track, the group or representation id and the index keep two
+// tracks of the same media type apart.
+func trackID(mediatype string, groupid string, idx int) string {
+	var name strings.Builder
+	for _, c := range groupid {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			name.WriteRune(c)
+		}
+	}
+
+	if name.Len() > 0 {
+		return fmt.Sprintf("master_%s_%s_%d", mediatype, name.String(), idx)
+	}
+
+	return fmt.Sprintf("master_%s_%d", mediatype, idx)
+}
+
+func (namer *OutputNamer) expand(fields NameFields) string {
+	replacer := strings.NewReplacer(
+		"{kid}", sanitizeName(fields.KID),
+		"{kid62}", sanitizeName(kid62(fields.KID)),
+		"{language}", sanitizeName(fields.Language),
+		"{type}", sanitizeName(fields.Type),
+		"{codec}", sanitizeName(fields.Codec),
+		"{input_basename}", sanitizeName(fields.InputBasename),
+	)
+
+	return replacer.Replace(namer.Template)
+}
+
+// Resolve returns the destination for the output at src, applying the collision policy.
+// errOutputExists is returned when the policy is skip and the destination is taken.
+func (namer *OutputNamer) Resolve(src string, fields NameFields) (string, error) {
+	extension := filepath.Ext(src)
+	name := strings.TrimSuffix(filepath.Base(src), extension)
+
+	if len(namer.Template) > 0 {
+		name = namer.expand(fields)
+		if len(strings.TrimSpace(name)) == 0 {
+			return "", fmt.Errorf("name template %q expands to an empty name", namer.Template)
+		}
+	}
+
+	return namer.claim(name, extension)
+}
+
+// claim applies the collision policy to name+extension in the output directory.
+func (namer *OutputNamer) claim(name string, extension string) (string, error) {
+	dest := filepath.Join(namer.Dir, name+extension)
+
+	_, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return dest, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch namer.Collision {
+	case "overwrite", "":
+		return dest, nil
+	case "skip":
+		return dest, errOutputExists
+	case "suffix":
+		for idx := 1; ; idx++ {
+			candidate := filepath.Join(namer.Dir, fmt.Sprintf("%s_%d%s", name, idx, extension))
+			if _, err := os.Stat(candidate); os.IsNotExist(err) {
+				return candidate, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("unknown collision policy %q", namer.Collision)
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// moveFile renames src to dest. When they are on different filesystems src is copied next to dest
+// first and renamed from there so dest never shows up half written.
+func moveFile(src string, dest string) error {
+	if src == dest {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dest)
+	if err == nil {
+		return nil
+	}
+
+	tmpfile, err := os.CreateTemp(filepath.Dir(dest), ".blurlconvert-*")
+	if err != nil {
+		return err
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	err = copyFile(src, tmpfile.Name())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpfile.Name(), dest)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+func copyDir(src string, dest string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(dest, rel), 0755)
+		}
+
+		return copyFile(path, filepath.Join(dest, rel))
+	})
+}
+
+// moveDir moves the directory src to dest. src is staged next to dest first and an existing dest is
+// only swapped out once the new directory is complete, so dest never shows up half written.
+func moveDir(src string, dest string) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(dest), ".blurlconvert-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	staged := filepath.Join(staging, "new")
+
+	err = os.Rename(src, staged)
+	if err != nil {
+		err = copyDir(src, staged)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the replaced directory is parked in the staging directory and removed along with it
+	if _, err := os.Stat(dest); err == nil {
+		err = os.Rename(dest, filepath.Join(staging, "old"))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(staged, dest)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// placeDir moves the directory src to name in the output directory with the collision policy of
+// the outputs and returns where it went.
+func placeDir(namer *OutputNamer, src string, name string) (string, error) {
+	dest, err := namer.claim(name, "")
+
+	if errors.Is(err, errOutputExists) {
+		fmt.Printf("%s already exists, skipping\n", dest)
+		os.RemoveAll(src)
+		return dest, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = moveDir(src, dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to move %s to %s: %v", src, dest, err)
+	}
+
+	return dest, nil
+}
+
+type pendingOutput struct {
+	Path   string
+	Fields NameFields
+}
+
+// finalizeOutputs moves the finished outputs to their templated names and returns where each went.
+func finalizeOutputs(namer *OutputNamer, outputs []pendingOutput, checksums *ChecksumManifest) (map[string]string, error) {
+	placed := make(map[string]string)
+
+	for _, output := range outputs {
+		dest, err := namer.Resolve(output.Path, output.Fields)
+
+		if errors.Is(err, errOutputExists) {
+			fmt.Printf("%s already exists, skipping\n", dest)
+			os.Remove(output.Path)
+			placed[output.Path] = dest
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = moveFile(output.Path, dest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move %s to %s: %v", output.Path, dest, err)
+		}
+
+		err = checksums.AddFile(dest)
+		if err != nil {
+			return nil, err
+		}
+
+		placed[output.Path] = dest
+	}
+
+	return placed, nil
+}
+
+// finishOutputs places the outputs of a run and records where they went, merged is the muxed file
+// that replaced the per track outputs if there is one.
+func finishOutputs(pending []pendingOutput, merged string, checksums *ChecksumManifest, result *RunResult) error {
+	placed, err := finalizeOutputs(outputNamer(), pending, checksums)
+	if err != nil {
+		return err
+	}
+
+	result.Outputs = []string{}
+	for _, output := range pending {
+		result.Outputs = append(result.Outputs, placed[output.Path])
+	}
+
+	for idx := range result.Tracks {
+		if dest, ok := placed[result.Tracks[idx].Output]; ok {
+			result.Tracks[idx].Output = dest
+		} else if len(merged) > 0 {
+			result.Tracks[idx].Output = placed[merged]
+		}
+	}
+
+	if len(result.Outputs) == 0 {
+		return nil
+	}
+
+	result.Checksums, err = writeChecksumManifest(checksums, result.Outputs[len(result.Outputs)-1])
+	return err
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
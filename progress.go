@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress is set up from -progress in main, nil disables reporting
+var progress *Progress
+
+// stdout is the real standard output. When it carries json, os.Stdout is pointed at stderr so the
+// human readable messages printed along the way don't end up in between.
+var stdout = os.Stdout
+
+func reserveStdout() {
+	os.Stdout = os.Stderr
+}
+
+type trackProgress struct {
+	name          string
+	totalSegments int
+	segments      int
+	bytes         int64
+	start         time.Time
+}
+
+// Progress tracks downloaded bytes and segments per track and reports them either as a terminal
+// progress bar or as newline delimited json events. A nil Progress reports nothing.
+type Progress struct {
+	mu         sync.Mutex
+	out        io.Writer
+	json       bool
+	tracks     map[string]*trackProgress
+	lastRender time.Time
+}
+
+type ProgressEvent struct {
+	Event          string  `json:"event"`
+	Track          string  `json:"track"`
+	Time           string  `json:"time"`
+	SegmentsDone   int     `json:"segments_done"`
+	SegmentsTotal  int     `json:"segments_total"`
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETASeconds     float64 `json:"eta_seconds"`
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// NewProgress creates a reporter for mode "auto" (bar when stdout is a terminal), "bar", "json" or "none".
+func NewProgress(mode string) (*Progress, error) {
+	switch mode {
+	case "auto":
+		if !isTerminal(os.Stdout) {
+			return nil, nil
+		}
+	case "bar":
+	case "json":
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q", mode)
+	}
+
+	out := os.Stdout
+	if mode == "json" {
+		out = stdout
+	}
+
+	return &Progress{
+		out:    out,
+		json:   mode == "json",
+		tracks: make(map[string]*trackProgress),
+	}, nil
+}
+
+func (progress *Progress) StartTrack(track string, segments int) {
+	if progress == nil {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	state := &trackProgress{name: track, totalSegments: segments, start: time.Now()}
+	progress.tracks[track] = state
+
+	progress.report("track_start", state, true)
+}
+
+func (progress *Progress) AddBytes(track string, n int64) {
+	if progress == nil || n <= 0 {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	state, ok := progress.tracks[track]
+	if !ok {
+		return
+	}
+
+	state.bytes += n
+
+	// bytes arrive in small chunks so only the bar is redrawn for them
+	if !progress.json {
+		progress.report("progress", state, false)
+	}
+}
+
+func (progress *Progress) SegmentDone(track string) {
+	if progress == nil {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	state, ok := progress.tracks[track]
+	if !ok {
+		return
+	}
+
+	state.segments++
+
+	progress.report("progress", state, false)
+}
+
+func (progress *Progress) FinishTrack(track string) {
+	if progress == nil {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	state, ok := progress.tracks[track]
+	if !ok {
+		return
+	}
+
+	progress.report("track_done", state, true)
+
+	if !progress.json {
+		fmt.Fprintln(progress.out)
+	}
+
+	delete(progress.tracks, track)
+}
+
+// Reader counts the bytes read from r towards the track.
+func (progress *Progress) Reader(track string, r io.Reader) io.Reader {
+	if progress == nil {
+		return r
+	}
+
+	return &progressReader{progress: progress, track: track, reader: r}
+}
+
+type progressReader struct {
+	progress *Progress
+	track    string
+	reader   io.Reader
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.progress.AddBytes(r.track, int64(n))
+	return n, err
+}
+
+func (progress *Progress) report(event string, state *trackProgress, force bool) {
+	now := time.Now()
+
+	elapsed := now.Sub(state.start).Seconds()
+
+	var throughput, eta float64
+	if elapsed > 0 {
+		throughput = float64(state.bytes) / elapsed
+	}
+	if state.segments > 0 && state.totalSegments > state.segments {
+		eta = elapsed / float64(state.segments) * float64(state.totalSegments-state.segments)
+	}
+
+	if progress.json {
+		line, err := json.Marshal(ProgressEvent{
+			Event:          event,
+			Track:          state.name,
+			Time:           now.UTC().Format(time.RFC3339Nano),
+			SegmentsDone:   state.segments,
+			SegmentsTotal:  state.totalSegments,
+			Bytes:          state.bytes,
+			BytesPerSecond: throughput,
+			ETASeconds:     eta,
+		})
+		if err == nil {
+			fmt.Fprintln(progress.out, string(line))
+		}
+		return
+	}
+
+	if !force && now.Sub(progress.lastRender) < 100*time.Millisecond {
+		return
+	}
+	progress.lastRender = now
+
+	const width = 30
+	filled := 0
+	if state.totalSegments > 0 {
+		filled = width * state.segments / state.totalSegments
+	}
+	if filled > width {
+		filled = width
+	}
+
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+
+	fmt.Fprintf(progress.out, "\r%s [%s] %d/%d segments %s %s/s ETA %s   ", state.name, bar, state.segments, state.totalSegments, formatBytes(float64(state.bytes)), formatBytes(throughput), time.Duration(eta*float64(time.Second)).Round(time.Second).String())
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+
+	unit := 0
+	for n >= 1024 && unit < len(units)-1 {
+		n /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[unit])
+}
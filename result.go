@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+type PlaylistResult struct {
+	Language string `json:"language"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+}
+
+type TrackResult struct {
+	ContentType     string  `json:"content_type"`
+	Language        string  `json:"language,omitempty"`
+	Codecs          string  `json:"codecs,omitempty"`
+	Bandwidth       int64   `json:"bandwidth,omitempty"`
+	SampleRate      string  `json:"sample_rate,omitempty"`
+	KeyID           string  `json:"key_id,omitempty"`
+	Segments        int     `json:"segments"`
+	Output          string  `json:"output"`
+	DownloadSeconds float64 `json:"download_seconds"`
+}
+
+type RunTimings struct {
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	KeySeconds      float64   `json:"key_seconds"`
+	ManifestSeconds float64   `json:"manifest_seconds"`
+	DownloadSeconds float64   `json:"download_seconds"`
+	MergeSeconds    float64   `json:"merge_seconds"`
+	TotalSeconds    float64   `json:"total_seconds"`
+}
+
+// RunResult is the machine readable summary of a run written by -json.
+type RunResult struct {
+	Input        string          `json:"input"`
+	Playlist     *PlaylistResult `json:"playlist,omitempty"`
+	Format       string          `json:"format,omitempty"`
+	KeyID        string          `json:"key_id,omitempty"`
+	Key          string          `json:"key,omitempty"`
+	Duration     float64         `json:"duration_seconds"`
+	SegmentCount int             `json:"segment_count"`
+	Tracks       []TrackResult   `json:"tracks"`
+	Outputs      []string        `json:"outputs"`
+	HLS          string          `json:"hls,omitempty"`
+	Checksums    string          `json:"checksums,omitempty"`
+	Timings      RunTimings      `json:"timings"`
+	Success      bool            `json:"success"`
+	Error        string          `json:"error,omitempty"`
+}
+
+func NewRunResult(input string) *RunResult {
+	return &RunResult{
+		Input:   input,
+		Tracks:  []TrackResult{},
+		Outputs: []string{},
+		Timings: RunTimings{Started: time.Now()},
+	}
+}
+
+func secondsSince(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+func (result *RunResult) SetPlaylist(playlist *Playlist) {
+	result.Playlist = &PlaylistResult{
+		Language: playlist.Language,
+		Type:     playlist.Type,
+		URL:      playlist.URL,
+	}
+}
+
+func (result *RunResult) SetKey(key []byte, redact bool) {
+	if len(key) == 0 {
+		return
+	}
+
+	if redact {
+		result.Key = "redacted"
+		return
+	}
+
+	result.Key = hex.EncodeToString(key)
+}
+
+func (result *RunResult) Finish(err error) {
+	result.Timings.Finished = time.Now()
+	result.Timings.TotalSeconds = result.Timings.Finished.Sub(result.Timings.Started).Seconds()
+	result.Success = err == nil
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
+
+// Write prints the result to stdout when path is empty or "-" and writes it to path otherwise.
+func (result *RunResult) Write(path string) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	if len(path) == 0 || path == "-" {
+		_, err = stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
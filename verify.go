@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type mp4Box struct {
+	Type    string
+	Payload []byte
+}
+
+func readBoxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated box header (%d bytes left)", len(data))
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxtype := string(data[4:8])
+		headersize := uint64(8)
+
+		switch size {
+		case 0:
+			// the box runs until the end of the file
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("truncated %s box header", boxtype)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headersize = 16
+		}
+
+		if size < headersize {
+			return nil, fmt.Errorf("invalid %s box size %d", boxtype, size)
+		}
+
+		if size > uint64(len(data)) {
+			return nil, fmt.Errorf("%s box claims %d bytes but only %d are left", boxtype, size, len(data))
+		}
+
+		boxes = append(boxes, mp4Box{Type: boxtype, Payload: data[headersize:size]})
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
+
+// ValidateSegment checks that a media segment is made of complete boxes with every moof followed by
+// its mdat and returns the mfhd sequence numbers of its fragments in order.
+func ValidateSegment(data []byte) ([]uint32, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var sequences []uint32
+	pendingmoof := false
+
+	for _, box := range boxes {
+		switch box.Type {
+		case "moof":
+			if pendingmoof {
+				return nil, errors.New("moof without a matching mdat")
+			}
+
+			children, err := readBoxes(box.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("invalid moof: %v", err)
+			}
+
+			found := false
+			for _, child := range children {
+				if child.Type != "mfhd" {
+					continue
+				}
+				// full box header (version + flags) followed by the sequence number
+				if len(child.Payload) < 8 {
+					return nil, errors.New("truncated mfhd box")
+				}
+				sequences = append(sequences, binary.BigEndian.Uint32(child.Payload[4:8]))
+				found = true
+				break
+			}
+
+			if !found {
+				return nil, errors.New("moof without an mfhd box")
+			}
+
+			pendingmoof = true
+		case "mdat":
+			if !pendingmoof {
+				return nil, errors.New("mdat without a preceding moof")
+			}
+			pendingmoof = false
+		}
+	}
+
+	if pendingmoof {
+		return nil, errors.New("moof without a matching mdat")
+	}
+
+	if len(sequences) == 0 {
+		return nil, errors.New("segment has no movie fragments")
+	}
+
+	return sequences, nil
+}
+
+// SequenceChecker makes sure fragment sequence numbers increase by exactly one across segments.
+type SequenceChecker struct {
+	last    uint32
+	started bool
+}
+
+func (checker *SequenceChecker) Check(segment string, sequences []uint32) error {
+	for _, sequence := range sequences {
+		if checker.started && sequence != checker.last+1 {
+			return fmt.Errorf("%s: fragment sequence number %d does not follow %d", segment, sequence, checker.last)
+		}
+
+		checker.last = sequence
+		checker.started = true
+	}
+
+	return nil
+}
+
+type checksumEntry struct {
+	name string
+	sum  string
+	file bool
+}
+
+// ChecksumManifest collects sha256 sums of segments and outputs and writes them in sha256sum format.
+// Outputs are files that `sha256sum -c` can check, segments only exist while the run lasts so their
+// sums go to a manifest of their own.
+type ChecksumManifest struct {
+	mu      sync.Mutex
+	entries []checksumEntry
+}
+
+func (manifest *ChecksumManifest) Add(name string, data []byte) {
+	if manifest == nil {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+
+	manifest.entries = append(manifest.entries, checksumEntry{name: name, sum: hex.EncodeToString(sum[:])})
+}
+
+func (manifest *ChecksumManifest) AddFile(filename string) error {
+	if manifest == nil {
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+
+	manifest.entries = append(manifest.entries, checksumEntry{name: filename, sum: hex.EncodeToString(hash.Sum(nil)), file: true})
+
+	return nil
+}
+
+// Write stores the outputs as <result>.sha256 next to the result file, with paths relative to it so
+// `sha256sum -c` works from that directory, and the segments as <result>.segments.sha256.
+func (manifest *ChecksumManifest) Write(result string) (string, error) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+
+	sidecar := result + ".sha256"
+	dir, err := filepath.Abs(filepath.Dir(sidecar))
+	if err != nil {
+		return "", err
+	}
+
+	var files, segments strings.Builder
+	for _, entry := range manifest.entries {
+		if !entry.file {
+			segments.WriteString(fmt.Sprintf("%s  %s\n", entry.sum, filepath.ToSlash(entry.name)))
+			continue
+		}
+
+		name, err := filepath.Abs(entry.name)
+		if err == nil {
+			name, err = filepath.Rel(dir, name)
+		}
+		if err != nil {
+			name = entry.name
+		}
+
+		files.WriteString(fmt.Sprintf("%s  %s\n", entry.sum, filepath.ToSlash(name)))
+	}
+
+	if segments.Len() > 0 {
+		err = os.WriteFile(result+".segments.sha256", []byte(segments.String()), 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return sidecar, os.WriteFile(sidecar, []byte(files.String()), 0644)
+}
+
+func writeChecksumManifest(manifest *ChecksumManifest, result string) (string, error) {
+	if manifest == nil {
+		return "", nil
+	}
+
+	sidecar, err := manifest.Write(result)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println("Checksums written to", sidecar)
+	return sidecar, nil
+}
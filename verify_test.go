@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumManifestWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	output := filepath.Join(dir, "out", "master.mp4")
+	err := os.MkdirAll(filepath.Dir(output), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(output, []byte("output"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest ChecksumManifest
+	manifest.Add("master_video/segment_1.m4s", []byte("segment"))
+
+	err = manifest.AddFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar, err := manifest.Write(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(string(files), "  master.mp4\n") || strings.Contains(string(files), "segment_1") {
+		t.Fatalf("unexpected output manifest:\n%s", files)
+	}
+
+	segments, err := os.ReadFile(output + ".segments.sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(string(segments), "  master_video/segment_1.m4s\n") {
+		t.Fatalf("unexpected segment manifest:\n%s", segments)
+	}
+
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		return
+	}
+
+	cmd := exec.Command("sha256sum", "-c", filepath.Base(sidecar))
+	cmd.Dir = filepath.Dir(sidecar)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("sha256sum -c failed: %v\n%s", err, out)
+	}
+}